@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+// build the answer to an HSS initiated S6a request
+// parameters:
+// - m: the request being answered
+// - cfg: settings of the mme answering
+// - sessionID: Session-Id of the request
+// - resultCode: Result-Code of the answer, ignored if experimentalCode is set
+// - experimentalCode: 3GPP Experimental-Result-Code (e.g. DIAMETER_ERROR_USER_UNKNOWN), 0 for none
+func newS6aAnswer(m *diam.Message, cfg *sm.Settings, sessionID string,
+	resultCode uint32, experimentalCode uint32) *diam.Message {
+	var a *diam.Message
+	if experimentalCode != 0 {
+		a = diam.NewMessage(m.Header.CommandCode, m.Header.CommandFlags&^diam.RequestFlag,
+			m.Header.ApplicationID, m.Header.HopByHopID, m.Header.EndToEndID, m.Dictionary())
+		a.NewAVP(avp.ExperimentalResult, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(*vendorID)),
+				diam.NewAVP(avp.ExperimentalResultCode, avp.Mbit, 0, datatype.Unsigned32(experimentalCode)),
+			},
+		})
+	} else {
+		a = m.Answer(resultCode)
+	}
+	// Session-Id has to be the first AVP
+	a.InsertAVP(diam.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sessionID)))
+	a.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(1))
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	a.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	return a
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+// an imsi registered through one of our mme's
+type Attachment struct {
+	IMSI string
+	Conn diam.Conn
+	Cfg  *sm.Settings
+}
+
+var (
+	attachLock sync.Mutex
+	// sid of an outstanding ULR/PUR to where it was sent
+	pendingAttachments = make(map[int]Attachment)
+	// imsi to the mme it is attached to, as far as the tool knows
+	attachments = make(map[string]Attachment)
+)
+
+// remember where the ULR/PUR of sid went, so its answer can update the attachment
+func trackAttachment(sid int, imsi string, c diam.Conn, cfg *sm.Settings) {
+	attachLock.Lock()
+	pendingAttachments[sid] = Attachment{imsi, c, cfg}
+	attachLock.Unlock()
+}
+
+// the answer to sid came back, a successful ULA attaches the imsi and
+// a successful PUA detaches it
+func updateAttachment(sid int, success bool, attach bool) {
+	attachLock.Lock()
+	defer attachLock.Unlock()
+	a, ok := pendingAttachments[sid]
+	delete(pendingAttachments, sid)
+	if !ok || !success {
+		return
+	}
+	if attach {
+		attachments[a.IMSI] = a
+	} else {
+		delete(attachments, a.IMSI)
+	}
+}
+
+// the hss cancelled the registration of imsi at the mme with cfg
+func detach(imsi string, cfg *sm.Settings) {
+	attachLock.Lock()
+	if a, ok := attachments[imsi]; ok && a.Cfg == cfg {
+		delete(attachments, imsi)
+	}
+	attachLock.Unlock()
+}
+
+// return: the imsis attached to the mme with cfg starting with one of the prefixes,
+// all of the mme's imsis if there are no prefixes
+func attachedWithPrefix(cfg *sm.Settings, prefixes []string) []Attachment {
+	var found []Attachment
+	attachLock.Lock()
+	defer attachLock.Unlock()
+	for imsi, a := range attachments {
+		if a.Cfg != cfg {
+			continue
+		}
+		if len(prefixes) == 0 {
+			found = append(found, a)
+			continue
+		}
+		for i := 0; i < len(prefixes); i++ {
+			if len(imsi) >= len(prefixes[i]) && imsi[:len(prefixes[i])] == prefixes[i] {
+				found = append(found, a)
+				break
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+// a Cancel-Location Request the HSS sent to one of our mme's
+type Cancellation struct {
+	IMSI             string
+	CancellationType int32
+	CLRFlags         uint32
+	MME              string
+	HSS              net.Addr
+	Time             time.Time
+}
+
+var (
+	cancellationsLock sync.Mutex
+	cancellations     []Cancellation
+)
+
+// Handle CLR
+// records the cancellation and answers with *clrResult (or *clrExperimentalResult if set)
+// parameters: cfg of the mme the request was sent to
+func handleCancelLocationRequest(cfg *sm.Settings) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Cancel-Location Request from %s\n%s\n", c.RemoteAddr(), m)
+		var clr CLR
+		err := m.Unmarshal(&clr)
+		if err != nil {
+			log.Printf("CLR Unmarshal failed: %s", err)
+			return
+		}
+
+		cancellationsLock.Lock()
+		cancellations = append(cancellations, Cancellation{
+			IMSI:             clr.UserName,
+			CancellationType: clr.CancellationType,
+			CLRFlags:         clr.CLRFlags,
+			MME:              string(cfg.OriginHost),
+			HSS:              c.RemoteAddr(),
+			Time:             time.Now(),
+		})
+		cancellationsLock.Unlock()
+		detach(clr.UserName, cfg)
+
+		a := newS6aAnswer(m, cfg, clr.SessionID, uint32(*clrResult), uint32(*clrExperimentalResult))
+		// log.Printf("\nSending CLA to %s\n%s\n", c.RemoteAddr(), a)
+		_, err = a.WriteTo(c)
+		if err != nil {
+			log.Printf("failed to send CLA to %s: %s", c.RemoteAddr(), err)
+		}
+	}
+}
+
+// return: the cancellations of imsi that mme received since the given time
+func cancellationsOf(imsi string, mme string, since time.Time) []Cancellation {
+	var found []Cancellation
+	cancellationsLock.Lock()
+	defer cancellationsLock.Unlock()
+	for i := 0; i < len(cancellations); i++ {
+		if cancellations[i].IMSI == imsi && cancellations[i].MME == mme && !cancellations[i].Time.Before(since) {
+			found = append(found, cancellations[i])
+		}
+	}
+	return found
+}
+
+// print how many of the imsis were cancelled at mme since the given time,
+// i.e. whether the HSS cancelled the old registration after a re-registration elsewhere
+func printCancellations(index int, testName string, imsis []*string, mme string, since time.Time) {
+	cancelled := 0
+	for i := 0; i < len(imsis); i++ {
+		if len(cancellationsOf(*imsis[i], mme, since)) > 0 {
+			cancelled++
+		} else {
+			log.Printf("   imsi %s was not cancelled at %s\n", *imsis[i], mme)
+		}
+	}
+	log.Printf("%d. %s:", index, testName)
+	log.Printf("   Cancelled: %d\n", cancelled)
+	log.Printf("   Not Cancelled: %d\n", len(imsis)-cancelled)
+}
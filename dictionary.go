@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// S6a and S13 command codes missing from diam's command list
+const (
+	InsertSubscriberData = 319
+	DeleteSubscriberData = 320
+	MEIdentityCheck      = 324
+)
+
+// S13 (MME - EIR) application
+const TGPP_S13_APP_ID = 16777252
+
+// load the parts of TS 29.272 the default dictionary does not have,
+// otherwise messages of them can't even be read off the connection
+func init() {
+	_, err := dict.Default.FindCommand(diam.TGPP_S6A_APP_ID, InsertSubscriberData)
+	if err != nil {
+		if err = dict.Default.Load(bytes.NewReader([]byte(s6aSubscriberDataXML))); err != nil {
+			log.Fatalf("failed to load S6a subscriber data dictionary: %s", err)
+		}
+	}
+	_, err = dict.Default.FindCommand(TGPP_S13_APP_ID, MEIdentityCheck)
+	if err != nil {
+		if err = dict.Default.Load(bytes.NewReader([]byte(s13XML))); err != nil {
+			log.Fatalf("failed to load S13 dictionary: %s", err)
+		}
+	}
+}
+
+var s6aSubscriberDataXML = `<?xml version="1.0" encoding="UTF-8"?>
+<diameter>
+    <application id="16777251" type="auth" name="TGPP S6A">
+        <vendor id="10415" name="TGPP"/>
+        <command code="319" short="ID" name="Insert-Subscriber-Data">
+            <request>
+                <rule avp="Session-Id" required="true" max="1"/>
+                <rule avp="Vendor-Specific-Application-Id" required="false" max="1"/>
+                <rule avp="Auth-Session-State" required="true" max="1"/>
+                <rule avp="Origin-Host" required="true" max="1"/>
+                <rule avp="Origin-Realm" required="true" max="1"/>
+                <rule avp="Destination-Host" required="true" max="1"/>
+                <rule avp="Destination-Realm" required="true" max="1"/>
+                <rule avp="User-Name" required="true" max="1"/>
+                <rule avp="Supported-Features" required="false"/>
+                <rule avp="Subscription-Data" required="true" max="1"/>
+                <rule avp="IDR-Flags" required="false" max="1"/>
+                <rule avp="Proxy-Info" required="false"/>
+                <rule avp="Route-Record" required="false"/>
+            </request>
+            <answer>
+                <rule avp="Session-Id" required="true" max="1"/>
+                <rule avp="Vendor-Specific-Application-Id" required="false" max="1"/>
+                <rule avp="Supported-Features" required="false"/>
+                <rule avp="Result-Code" required="false" max="1"/>
+                <rule avp="Experimental-Result" required="false" max="1"/>
+                <rule avp="Auth-Session-State" required="true" max="1"/>
+                <rule avp="Origin-Host" required="true" max="1"/>
+                <rule avp="Origin-Realm" required="true" max="1"/>
+                <rule avp="IDA-Flags" required="false" max="1"/>
+                <rule avp="Failed-AVP" required="false" max="1"/>
+                <rule avp="Proxy-Info" required="false"/>
+                <rule avp="Route-Record" required="false"/>
+            </answer>
+        </command>
+
+        <command code="320" short="DS" name="Delete-Subscriber-Data">
+            <request>
+                <rule avp="Session-Id" required="true" max="1"/>
+                <rule avp="Vendor-Specific-Application-Id" required="false" max="1"/>
+                <rule avp="Auth-Session-State" required="true" max="1"/>
+                <rule avp="Origin-Host" required="true" max="1"/>
+                <rule avp="Origin-Realm" required="true" max="1"/>
+                <rule avp="Destination-Host" required="true" max="1"/>
+                <rule avp="Destination-Realm" required="true" max="1"/>
+                <rule avp="User-Name" required="true" max="1"/>
+                <rule avp="Supported-Features" required="false"/>
+                <rule avp="DSR-Flags" required="true" max="1"/>
+                <rule avp="Context-Identifier" required="false"/>
+                <rule avp="Trace-Reference" required="false" max="1"/>
+                <rule avp="TS-Code" required="false"/>
+                <rule avp="SS-Code" required="false"/>
+                <rule avp="Proxy-Info" required="false"/>
+                <rule avp="Route-Record" required="false"/>
+            </request>
+            <answer>
+                <rule avp="Session-Id" required="true" max="1"/>
+                <rule avp="Vendor-Specific-Application-Id" required="false" max="1"/>
+                <rule avp="Supported-Features" required="false"/>
+                <rule avp="Result-Code" required="false" max="1"/>
+                <rule avp="Experimental-Result" required="false" max="1"/>
+                <rule avp="Auth-Session-State" required="true" max="1"/>
+                <rule avp="Origin-Host" required="true" max="1"/>
+                <rule avp="Origin-Realm" required="true" max="1"/>
+                <rule avp="DSA-Flags" required="false" max="1"/>
+                <rule avp="Failed-AVP" required="false" max="1"/>
+                <rule avp="Proxy-Info" required="false"/>
+                <rule avp="Route-Record" required="false"/>
+            </answer>
+        </command>
+
+        <avp name="IDR-Flags" code="1490" must="V" must-not="M" may-encrypt="N" vendor-id="10415">
+            <data type="Unsigned32"/>
+        </avp>
+
+        <avp name="IDA-Flags" code="1441" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="Unsigned32"/>
+        </avp>
+
+        <avp name="DSR-Flags" code="1421" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="Unsigned32"/>
+        </avp>
+
+        <avp name="DSA-Flags" code="1422" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="Unsigned32"/>
+        </avp>
+    </application>
+</diameter>
+`
+
+var s13XML = `<?xml version="1.0" encoding="UTF-8"?>
+<diameter>
+    <application id="16777252" type="auth" name="TGPP S13">
+        <vendor id="10415" name="TGPP"/>
+        <command code="324" short="EC" name="ME-Identity-Check">
+            <request>
+                <rule avp="Session-Id" required="true" max="1"/>
+                <rule avp="Vendor-Specific-Application-Id" required="false" max="1"/>
+                <rule avp="Auth-Session-State" required="true" max="1"/>
+                <rule avp="Origin-Host" required="true" max="1"/>
+                <rule avp="Origin-Realm" required="true" max="1"/>
+                <rule avp="Destination-Host" required="false" max="1"/>
+                <rule avp="Destination-Realm" required="true" max="1"/>
+                <rule avp="Terminal-Information" required="true" max="1"/>
+                <rule avp="User-Name" required="false" max="1"/>
+                <rule avp="Proxy-Info" required="false"/>
+                <rule avp="Route-Record" required="false"/>
+            </request>
+            <answer>
+                <rule avp="Session-Id" required="true" max="1"/>
+                <rule avp="Vendor-Specific-Application-Id" required="false" max="1"/>
+                <rule avp="Result-Code" required="false" max="1"/>
+                <rule avp="Experimental-Result" required="false" max="1"/>
+                <rule avp="Auth-Session-State" required="true" max="1"/>
+                <rule avp="Origin-Host" required="true" max="1"/>
+                <rule avp="Origin-Realm" required="true" max="1"/>
+                <rule avp="Equipment-Status" required="false" max="1"/>
+                <rule avp="Failed-AVP" required="false" max="1"/>
+                <rule avp="Proxy-Info" required="false"/>
+                <rule avp="Route-Record" required="false"/>
+            </answer>
+        </command>
+
+        <avp name="Terminal-Information" code="1401" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="Grouped">
+                <rule avp="IMEI" required="false" max="1"/>
+                <rule avp="3GPP2-MEID" required="false" max="1"/>
+                <rule avp="Software-Version" required="false" max="1"/>
+            </data>
+        </avp>
+
+        <avp name="IMEI" code="1402" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="UTF8String"/>
+        </avp>
+
+        <avp name="3GPP2-MEID" code="1471" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="OctetString"/>
+        </avp>
+
+        <avp name="Software-Version" code="1403" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="UTF8String"/>
+        </avp>
+
+        <avp name="Equipment-Status" code="1445" must="M,V" may-encrypt="N" vendor-id="10415">
+            <data type="Enumerated">
+                <item code="0" name="WHITELISTED"/>
+                <item code="1" name="BLACKLISTED"/>
+                <item code="2" name="GREYLISTED"/>
+            </data>
+        </avp>
+    </application>
+</diameter>
+`
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+// Disconnect-Cause values (RFC 6733 5.4.3)
+const (
+	REBOOTING                  = 0
+	BUSY                       = 1
+	DO_NOT_WANT_TO_TALK_TO_YOU = 2
+)
+
+var disconnectPeerAnswerIdx = diam.CommandIndex{AppID: 0, Code: diam.DisconnectPeer, Request: false}
+
+var (
+	// closed on SIGINT/SIGTERM, the running test stops starting requests and no more tests run
+	shuttingDown = make(chan struct{})
+
+	dpaLock sync.Mutex
+	// sid of a DPR sent on shutdown to the channel waiting for its DPA
+	dpaWaiters = make(map[int]chan DPA)
+)
+
+// finish up gracefully on the first SIGINT/SIGTERM, exit right away on the second
+func handleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("%s: draining and disconnecting, again to exit right away", sig)
+		close(shuttingDown)
+		sig = <-sigs
+		log.Printf("%s: exiting", sig)
+		os.Exit(1)
+	}()
+}
+
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait up to timeout for the answers to every outstanding request
+func drainTransactions(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for pending := pendingTransactions(); pending != 0; pending = pendingTransactions() {
+		if time.Now().After(deadline) {
+			log.Printf("gave up draining %d outstanding requests", pending)
+			return
+		}
+		expireTransactions(time.Now())
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Create & send Disconnect-Peer Request
+// sent back the sid through the sent channel
+func sendDPR(c diam.Conn, cfg *sm.Settings, cause int, randomVal int, sent chan int, sentErr chan int) {
+	m := diam.NewRequest(diam.DisconnectPeer, 0, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	m.NewAVP(avp.DisconnectCause, avp.Mbit, 0, datatype.Enumerated(cause))
+	// log.Printf("\nSending DPR to %s\n%s\n", c.RemoteAddr(), m)
+	err := sendRequest(c, m, randomVal, "DPR")
+	if err != nil {
+		sentErr <- randomVal
+	} else {
+		sent <- randomVal
+	}
+}
+
+// Handle DPA
+// the DPR of a disconnectTest sends back the result through the ReceivedResult channel,
+// the one of a shutdown goes to disconnectPeers
+// either way the transport is closed, as the sender of the DPR has to, but only for the
+// answer to a DPR that was sent: a late or unsolicited DPA leaves the connection be
+func handleDisconnectPeerAnswer(received chan ReceivedResult) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Disconnect-Peer Answer from %s\n%s\n", c.RemoteAddr(), m)
+		countAnswer(c, m, "DPR")
+		sid, ok := matchAnswer(m)
+		if !ok {
+			return
+		}
+		defer c.Close()
+		var dpa DPA
+		err := m.Unmarshal(&dpa)
+		dpaLock.Lock()
+		waiter, shutdown := dpaWaiters[sid]
+		delete(dpaWaiters, sid)
+		dpaLock.Unlock()
+		switch {
+		case shutdown:
+			waiter <- dpa
+		case err != nil:
+			log.Printf("DPA Unmarshal failed: %s", err)
+			sendResult(received, ReceivedResult{sid, -2, c.RemoteAddr(), "DPR", answerResult(m)})
+		case validateDPAResponse(dpa) == 1:
+			sendResult(received, ReceivedResult{sid, 0, c.RemoteAddr(), "DPR", answerResult(m)})
+		default:
+			sendResult(received, ReceivedResult{sid, -1, c.RemoteAddr(), "DPR", answerResult(m)})
+		}
+	}
+}
+
+func validateDPAResponse(dpa DPA) int {
+	if dpa.ResultCode != 0x7d1 {
+		log.Printf("DPA from %s returned result %d", dpa.OriginHost, dpa.ResultCode)
+		return 0
+	}
+	if dpa.OriginHost == "" {
+		log.Printf("DPA without Origin-Host")
+		return 0
+	}
+	return 1
+}
+
+// stop reconnecting, send a DPR with -disconnect_cause to every connected peer, wait up to
+// -dpa_timeout for its DPA and close the connection
+func disconnectPeers(peers map[string]*Peer) {
+	for name, p := range peers {
+		conn, ok := p.shutdown()
+		if !ok {
+			continue
+		}
+		sid := nextSID()
+		answer := make(chan DPA, 1)
+		dpaLock.Lock()
+		dpaWaiters[sid] = answer
+		dpaLock.Unlock()
+
+		sentErr := make(chan int, 1)
+		sendDPR(conn, p.Cfg, *disconnectCause, sid, make(chan int, 1), sentErr)
+		select {
+		case <-sentErr:
+			log.Printf("failed to send DPR to %s", name)
+		case dpa := <-answer:
+			log.Printf("disconnected from %s: DPA result %d", name, dpa.ResultCode)
+		case <-time.After(*dpaTimeout):
+			log.Printf("no DPA from %s, closing anyway", name)
+		}
+		conn.Close()
+	}
+}
+
+// disconnectTest() is a testFunc for how an hss handles being disconnected from
+// return: a function that takes in an []int of sids, a Disconnect-Cause, and two sent channels (one good, one error)
+// parameters: the peer to disconnect from
+// connects to the peer again and sends a DPR with the cause on the new connection,
+// runScheduledTest is given causes instead of imsis
+// the connection is from an Origin-Host of its own, dpr.<host of the peer's mme>, so an hss
+// that allows one connection per peer or runs an election doesn't drop the peer's one
+func disconnectTest(peer *Peer) func([]int, *string, chan int, chan int) {
+	return func(sids []int, cause *string, sent chan int, sentErr chan int) {
+		n, err := strconv.Atoi(*cause)
+		if err != nil {
+			sentErr <- sids[0]
+			return
+		}
+		cfg := newSettings("dpr." + string(peer.Cfg.OriginHost))
+		conn := connect(peer.Addr, cfg, peer.AppID,
+			func(mux *sm.StateMachine, cfg *sm.Settings) {
+				mux.HandleIdx(disconnectPeerAnswerIdx, handleDisconnectPeerAnswer(received))
+			})
+		if conn == nil {
+			sentErr <- sids[0]
+			return
+		}
+		sendDPR(conn, cfg, n, sids[0], sent, sentErr)
+	}
+}
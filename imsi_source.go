@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// where runScheduledTest gets the imsi of each testFunc from
+// parsed from a spec with newIMSISource:
+// - 001010123456789,208920100001100   a list, cycled through in order
+// - 001010000000000-001010000099999   a range, cycled through in order
+// - random:001010000000000-001010000099999   random imsis out of a range
+// - 001/01/xxxxxxxxxx   MCC/MNC + MSIN pattern, every x is a random digit
+// - mix:good:80,bad:20   weighted random mix of other named sources
+// - ordered:good:2,bad:1   the same, taking that many from each source in turn
+// - subscribers   the imsis of the subscriber file, in order
+type IMSISource interface {
+	// the imsi for the next testFunc
+	Next() *string
+	// number of distinct imsis in order, 0 if the source is random
+	Len() int
+}
+
+// a fixed list of imsis
+type listSource struct {
+	imsis []string
+	next  int
+}
+
+func (s *listSource) Next() *string {
+	imsi := s.imsis[s.next]
+	s.next = (s.next + 1) % len(s.imsis)
+	return &imsi
+}
+
+func (s *listSource) Len() int {
+	return len(s.imsis)
+}
+
+// every imsi between first and last, zero padded to width digits
+type rangeSource struct {
+	first  uint64
+	last   uint64
+	width  int
+	next   uint64
+	random bool
+}
+
+func (s *rangeSource) Next() *string {
+	var n uint64
+	if s.random {
+		n = s.first + uint64(rand.Int63n(int64(s.last-s.first+1)))
+	} else {
+		n = s.first + s.next
+		s.next = (s.next + 1) % (s.last - s.first + 1)
+	}
+	imsi := strconv.FormatUint(n, 10)
+	imsi = strings.Repeat("0", s.width-len(imsi)) + imsi
+	return &imsi
+}
+
+func (s *rangeSource) Len() int {
+	if s.random {
+		return 0
+	}
+	return int(s.last - s.first + 1)
+}
+
+// an imsi pattern whose x's are replaced with random digits
+type patternSource struct {
+	pattern string
+}
+
+func (s *patternSource) Next() *string {
+	b := []byte(s.pattern)
+	for i := 0; i < len(b); i++ {
+		if b[i] == 'x' {
+			b[i] = byte('0' + rand.Intn(10))
+		}
+	}
+	imsi := string(b)
+	return &imsi
+}
+
+func (s *patternSource) Len() int {
+	return 0
+}
+
+// picks one of its sources at random for every imsi, weighted, or if ordered
+// weight imsis from each source in turn, so a test gets the same imsis every run
+type mixSource struct {
+	sources []IMSISource
+	weights []int
+	total   int
+	ordered bool
+	next    int
+}
+
+func (s *mixSource) Next() *string {
+	n := rand.Intn(s.total)
+	if s.ordered {
+		n = s.next
+		s.next = (s.next + 1) % s.total
+	}
+	for i := 0; i < len(s.sources); i++ {
+		if n < s.weights[i] {
+			return s.sources[i].Next()
+		}
+		n -= s.weights[i]
+	}
+	return s.sources[len(s.sources)-1].Next()
+}
+
+func (s *mixSource) Len() int {
+	return 0
+}
+
+// remembers every distinct imsi a source handed out, for checks after a test
+type recordingSource struct {
+	IMSISource
+	seen map[string]bool
+	used []*string
+}
+
+func newRecordingSource(src IMSISource) *recordingSource {
+	return &recordingSource{IMSISource: src, seen: make(map[string]bool)}
+}
+
+func (s *recordingSource) Next() *string {
+	imsi := s.IMSISource.Next()
+	if !s.seen[*imsi] {
+		s.seen[*imsi] = true
+		s.used = append(s.used, imsi)
+	}
+	return imsi
+}
+
+// parse an imsi source spec, see IMSISource
+// parameters:
+// - spec: the spec to parse
+// - named: looks up the named sources a mix refers to, may be nil if mixes are not allowed
+func newIMSISource(spec string, named func(string) (IMSISource, error)) (IMSISource, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case spec == "":
+		return nil, errors.New("empty imsi source")
+	case spec == "subscribers":
+		if len(subscribers) == 0 {
+			return nil, errors.New("no subscriber file loaded")
+		}
+		return &listSource{imsis: subscriberIMSIs()}, nil
+	case strings.HasPrefix(spec, "mix:"):
+		return newMixSource(strings.TrimPrefix(spec, "mix:"), named, false)
+	case strings.HasPrefix(spec, "ordered:"):
+		return newMixSource(strings.TrimPrefix(spec, "ordered:"), named, true)
+	case strings.HasPrefix(spec, "random:"):
+		return newRangeSource(strings.TrimPrefix(spec, "random:"), true)
+	case strings.Contains(spec, "x"):
+		pattern := strings.Replace(spec, "/", "", -1)
+		if !isIMSI(strings.Replace(pattern, "x", "0", -1)) {
+			return nil, errors.New("invalid imsi pattern " + spec)
+		}
+		return &patternSource{pattern}, nil
+	case strings.Contains(spec, "-") && !strings.Contains(spec, ","):
+		return newRangeSource(spec, false)
+	}
+	imsis := strings.Split(spec, ",")
+	for i := 0; i < len(imsis); i++ {
+		imsis[i] = strings.TrimSpace(imsis[i])
+		if !isIMSI(imsis[i]) {
+			return nil, errors.New("invalid imsi " + imsis[i])
+		}
+	}
+	return &listSource{imsis: imsis}, nil
+}
+
+// first-last, both the same number of digits
+func newRangeSource(spec string, random bool) (IMSISource, error) {
+	bounds := strings.Split(spec, "-")
+	if len(bounds) != 2 || len(bounds[0]) != len(bounds[1]) ||
+		!isIMSI(bounds[0]) || !isIMSI(bounds[1]) {
+		return nil, errors.New("invalid imsi range " + spec)
+	}
+	first, err := strconv.ParseUint(bounds[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	last, err := strconv.ParseUint(bounds[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if last < first {
+		return nil, errors.New("imsi range " + spec + " ends before it starts")
+	}
+	return &rangeSource{first: first, last: last, width: len(bounds[0]), random: random}, nil
+}
+
+// name:weight,name:weight...
+func newMixSource(spec string, named func(string) (IMSISource, error), ordered bool) (IMSISource, error) {
+	if named == nil {
+		return nil, errors.New("imsi mix " + spec + " can not refer to other sources here")
+	}
+	mix := &mixSource{ordered: ordered}
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 2 {
+			return nil, errors.New("invalid imsi mix entry " + part)
+		}
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil || weight <= 0 {
+			return nil, errors.New("invalid weight in imsi mix entry " + part)
+		}
+		src, err := named(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		mix.sources = append(mix.sources, src)
+		mix.weights = append(mix.weights, weight)
+		mix.total += weight
+	}
+	return mix, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// at most 15 digits (TS 23.003 2.2), so the hss never gets a User-Name that can not be an imsi
+func isIMSI(s string) bool {
+	return len(s) <= 15 && isDigits(s)
+}
+
+// an imsi source spec in a scenario file, either a spec string or a list of imsis
+type IMSISpec string
+
+func (spec *IMSISpec) UnmarshalJSON(data []byte) error {
+	var imsis []string
+	if err := json.Unmarshal(data, &imsis); err == nil {
+		*spec = IMSISpec(strings.Join(imsis, ","))
+		return nil
+	}
+	return json.Unmarshal(data, (*string)(spec))
+}
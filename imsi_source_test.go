@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// the first n imsis of a source
+func take(src IMSISource, n int) []string {
+	imsis := make([]string, n)
+	for i := 0; i < n; i++ {
+		imsis[i] = *src.Next()
+	}
+	return imsis
+}
+
+func TestIMSISource(t *testing.T) {
+	tests := []struct {
+		spec string
+		len  int
+		want string
+	}{
+		{"001010123456789", 1, "001010123456789,001010123456789"},
+		{"001010123456789, 208920100001100", 2, "001010123456789,208920100001100,001010123456789"},
+		{"001010000000098-001010000000100", 3, "001010000000098,001010000000099,001010000000100,001010000000098"},
+		// ranges keep their leading zeros
+		{"0000-0001", 2, "0000,0001,0000"},
+	}
+	for _, test := range tests {
+		src, err := newIMSISource(test.spec, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+		want := strings.Split(test.want, ",")
+		if got := take(src, len(want)); src.Len() != test.len || strings.Join(got, ",") != test.want {
+			t.Errorf("%s: expected %d imsis %s got %d %s", test.spec, test.len, test.want, src.Len(), got)
+		}
+	}
+}
+
+func TestRandomIMSISource(t *testing.T) {
+	src, err := newIMSISource("random:001010000000000-001010000000009", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Len() != 0 {
+		t.Errorf("random source of %d imsis", src.Len())
+	}
+	for _, imsi := range take(src, 100) {
+		if len(imsi) != 15 || imsi < "001010000000000" || imsi > "001010000000009" {
+			t.Fatalf("imsi %s out of range", imsi)
+		}
+	}
+
+	src, err = newIMSISource("001/01/xxxxxxxxxx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imsi := range take(src, 100) {
+		if len(imsi) != 15 || !strings.HasPrefix(imsi, "00101") || !isDigits(imsi) {
+			t.Fatalf("imsi %s does not match the pattern", imsi)
+		}
+	}
+}
+
+func TestInvalidIMSISource(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"abc",
+		"001010123456789,",
+		"0010101234567890",
+		"12-3",
+		"5-1",
+		"001010000000000-0010100000000001",
+		"0010100000000000-0010100000000001",
+		"random:00101000000000a-001010000000001",
+		"001/01/xxxxxxxxxxx",
+		"001/0a/xxxxxxxxxx",
+		"mix:good:1",
+	} {
+		if _, err := newIMSISource(spec, nil); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestMixIMSISource(t *testing.T) {
+	named := func(name string) (IMSISource, error) {
+		if name == "good" {
+			return newIMSISource("1,2,3", nil)
+		}
+		return newIMSISource("7,8", nil)
+	}
+
+	src, err := newIMSISource("ordered:good:2,bad:1", named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(take(src, 7), ","); got != "1,2,7,3,1,8,2" {
+		t.Errorf("ordered mix: %s", got)
+	}
+
+	src, err = newIMSISource("mix:good:3,bad:1", named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := 0
+	for _, imsi := range take(src, 4000) {
+		if imsi < "7" {
+			good++
+		}
+	}
+	if good < 2800 || good > 3200 {
+		t.Errorf("%d of 4000 imsis from a source weighted 3 of 4", good)
+	}
+
+	for _, spec := range []string{"mix:good", "mix:good:0", "mix:good:x", "ordered:good:1,bad"} {
+		if _, err := newIMSISource(spec, named); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestRecordingSource(t *testing.T) {
+	list, _ := newIMSISource("1,2", nil)
+	src := newRecordingSource(list)
+	take(src, 5)
+	if len(src.used) != 2 || *src.used[0] != "1" || *src.used[1] != "2" {
+		t.Errorf("recorded %d imsis", len(src.used))
+	}
+}
+
+func TestIMSISpec(t *testing.T) {
+	tests := []struct {
+		json, want string
+	}{
+		{`"001010000000000-001010000000009"`, "001010000000000-001010000000009"},
+		{`["001010123456789","208920100001100"]`, "001010123456789,208920100001100"},
+	}
+	for _, test := range tests {
+		var spec IMSISpec
+		if err := spec.UnmarshalJSON([]byte(test.json)); err != nil || string(spec) != test.want {
+			t.Errorf("%s: expected %s got %s %v", test.json, test.want, spec, err)
+		}
+	}
+}
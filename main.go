@@ -10,7 +10,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
-	"strconv"
+	"os"
 	"time"
 
 	"github.com/fiorix/go-diameter/diam"
@@ -34,7 +34,89 @@ var (
 	appID           = flag.Uint("app", 16777251, "AuthApplicationID")
 	plmnID          = flag.String("plmnid", "\x00\xF1\x10", "Client (UE) PLMN ID")
 	vectors         = flag.Uint("vectors", 3, "Number Of Requested Auth Vectors")
+	authLoad        = flag.Bool("auth_load", false, "Run the AIR load tests after the ULR ones")
 	completionSleep = flag.Uint("sleep", 10, "After Completion Sleep Time (seconds)")
+	requestTimeout  = flag.Duration("request_timeout", 10*time.Second, "How long a request waits for its answer")
+	requestRetries  = flag.Int("request_retries", 0, "Times a request that timed out is retransmitted with the T flag")
+	drainTimeout    = flag.Duration("drain_timeout", 10*time.Second, "How long to wait for outstanding answers before disconnecting")
+	dpaTimeout      = flag.Duration("dpa_timeout", 5*time.Second, "How long to wait for the DPA of each peer on exit")
+	disconnectCause = flag.Int("disconnect_cause", REBOOTING,
+		"Disconnect-Cause of the DPRs sent on exit: 0 REBOOTING, 1 BUSY, 2 DO_NOT_WANT_TO_TALK_TO_YOU")
+	dprTest  = flag.Bool("dpr_test", false, "Run the Disconnect-Peer test with every Disconnect-Cause")
+	failover = flag.Bool("failover", false,
+		"Retransmit, and send while a peer is down, to the next peer of the same application instead of the same peer")
+	reconnectMin = flag.Duration("reconnect_min", time.Second, "First backoff before connecting again to a peer that is down")
+	reconnectMax = flag.Duration("reconnect_max", 30*time.Second, "Longest backoff before connecting again to a peer that is down")
+	peerWait     = flag.Duration("peer_wait", 10*time.Second, "How long requests to a peer that is down wait for it to reconnect")
+
+	// open loop load test of the built-in sequence
+	rate         = flag.Float64("rate", 0, "ULRs per second of the open loop load test, 0 to skip it")
+	rateDuration = flag.Duration("rate_duration", time.Minute, "How long the open loop load test runs")
+	profileSpec  = flag.String("profile", "",
+		"Load profile of an extra ULR load test, e.g. step:start_rate=100,step_rate=100,steps=10,hold=30s")
+
+	// max throughput search of the built-in sequence, and the SLOs every search checks by default
+	searchMinRate  = flag.Float64("search_min_rate", 10, "Lowest ULR rate the throughput search tries")
+	searchMaxRate  = flag.Float64("search_max_rate", 0, "Highest ULR rate the throughput search tries, 0 to skip it")
+	searchTrial    = flag.Duration("search_trial", 30*time.Second, "How long each rate of a throughput search runs")
+	sloFailureRate = flag.Float64("slo_failure_rate", 0.01, "Highest fraction of failed or missing answers a sustainable rate may have")
+	sloP99         = flag.Duration("slo_p99", time.Second, "Highest p99 latency a sustainable rate may have")
+
+	// machine readable results for CI, see writeResults
+	resultsJSON  = flag.String("results_json", "", "File to write the results of every test to as JSON, with every request and answer")
+	resultsCSV   = flag.String("results_csv", "", "File to write a CSV line per test to")
+	requestsCSV  = flag.String("requests_csv", "", "File to write a CSV line per sent request to")
+	resultsJUnit = flag.String("results_junit", "", "File to write the results to as JUnit XML")
+
+	// live metrics for soak tests, see metricsRegistry
+	metricsAddr = flag.String("metrics_addr", "", "Address to serve prometheus metrics on at /metrics, e.g. :9090, empty to disable")
+
+	// tests to run instead of the built-in sequence below
+	scenarioFile = flag.String("scenario", "", "JSON scenario file declaring peers, imsi sets and tests")
+
+	// s13 equipment identity checks, only run if there is an eir to connect to
+	eirAddr = flag.String("eir_addr", "", "address in form of ip:port of the eir, empty to skip S13")
+	eirHost = flag.String("eir_host", "mme.OpenAir5G.Alliance", "diameter identity host towards the eir")
+	imeis   = flag.String("imeis", "35254506000000,3525450600000001,3525450600000102",
+		"comma separated IMEIs (14-15 digits) or IMEISVs (16 digits) to check")
+
+	// milenage keys used to recompute the vectors of every AIA, leave empty to skip
+	ki  = flag.String("ki", "", "Subscriber Ki in hex, used to validate AIA vectors")
+	opc = flag.String("opc", "", "Subscriber OPc in hex, used to validate AIA vectors")
+
+	// subscriber file with per imsi keys and expected subscription data, see loadSubscribers
+	subscriberFile = flag.String("subscribers", "", "CSV subscriber file used as imsi source and to validate AIAs/ULAs")
+
+	// AUTS resynchronisation test, needs -ki/-opc or a subscriber file to build the AUTS
+	resync    = flag.Bool("resync", false, "Run the AUTS resynchronisation test")
+	resyncSQN = flag.Uint64("resync_sqn", 1<<32, "SQN_MS the mock UE claims in its AUTS")
+
+	// tests of the built-in sequence that change state on the hss for the good imsis
+	purgeTest  = flag.Bool("purge_test", false, "Run the 2 HSS purge test, which purges the good imsis")
+	notifyPDNs = flag.Bool("notify_test", false, "Run the Notify test, which updates the PDN GW of the good imsis")
+
+	// answers to HSS initiated Cancel-Location Requests
+	clrResult             = flag.Uint("clr_result", 2001, "Result-Code to answer CLRs with")
+	clrExperimentalResult = flag.Uint("clr_experimental_result", 0, "Experimental-Result-Code to answer CLRs with instead, 0 to disable")
+
+	// answers to HSS initiated Insert/Delete-Subscriber-Data Requests
+	idrAnswer = flag.String("idr_answer", "success", "How to answer IDRs: success, user_unknown or none")
+	idrDelay  = flag.Duration("idr_delay", 0, "Delay before answering IDRs")
+	dsrAnswer = flag.String("dsr_answer", "success", "How to answer DSRs: success, user_unknown or none")
+	dsrDelay  = flag.Duration("dsr_delay", 0, "Delay before answering DSRs")
+
+	// re-ULR every attached imsi a Reset Request covers
+	rsrReattach = flag.Bool("rsr_reattach", false, "Re-attach the affected imsis when the hss resets")
+
+	// what NORs report to the hss
+	norAPN       = flag.String("nor_apn", "oai.ipv4", "APN (Service-Selection) the PDN GW is reported for")
+	norContextID = flag.Uint("nor_context_id", 0, "Context-Identifier of the APN configuration, 0 to omit")
+	norPGWHost   = flag.String("nor_pgw_host", "pgw.OpenAir5G.Alliance", "Diameter identity of the dynamic PDN GW, empty to omit")
+	norPGWRealm  = flag.String("nor_pgw_realm", "OpenAir5G.Alliance", "Diameter realm of the dynamic PDN GW")
+	norPGWAddr   = flag.String("nor_pgw_addr", "", "IP address of the dynamic PDN GW, empty to omit")
+	norFlags     = flag.Uint("nor_flags", 0, "NOR-Flags bitmask")
+	norIMSVoice  = flag.Int("nor_ims_voice", -1,
+		"Homogeneous-Support-of-IMS-Voice-Over-PS-Sessions (0 NOT_SUPPORTED, 1 SUPPORTED), -1 to omit")
 
 	addrs = [2]*string{
 		flag.String("addr1", "127.0.0.1:3868", "address in form of ip:port to connect to"),
@@ -47,51 +129,14 @@ var (
 		flag.String("diam_host2", "mme.OpenAir5G.Alliance", "diameter identity host2"),
 	}
 
-	// test arrays of imsi's
-	ueIMSIs = []*string{
-		flag.String("imsi1", "001010123456789", "Client (UE) IMSI 1"),
-		flag.String("imsi2", "208920100001100", "Client (UE) IMSI 2"),
-		flag.String("imsi3", "208920100001101", "Client (UE) IMSI 3"),
-		flag.String("imsi4", "208920100001102", "Client (UE) IMSI 4"),
-		flag.String("imsi5", "208920100001103", "Client (UE) IMSI 5"),
-		flag.String("imsi6", "208920100001104", "Client (UE) IMSI 6"),
-		flag.String("imsi7", "208920100001105", "Client (UE) IMSI 7"),
-		flag.String("imsi8", "208920100001106", "Client (UE) IMSI 8"),
-		flag.String("imsi9", "208920100001107", "Client (UE) IMSI 9"),
-		flag.String("imsi10", "208920100001108", "Client (UE) IMSI 10"),
-		flag.String("imsi11", "208920100001109", "Client (UE) IMSI 11"),
-		flag.String("imsi12", "208920100001111", "Client (UE) IMSI 12"),
-	}
-
-	badUeIMSIs = []*string{
-		flag.String("badimsi1", "123456789123456", "Bad Client (UE) IMSI 1"),
-		flag.String("badimsi2", "123456789123457", "Bad Client (UE) IMSI 2"),
-		flag.String("badimsi3", "123456789123458", "Bad Client (UE) IMSI 3"),
-		flag.String("badimsi4", "123456789123459", "Bad Client (UE) IMSI 4"),
-		flag.String("badimsi5", "123456789123460", "Bad Client (UE) IMSI 5"),
-		flag.String("badimsi6", "123456789123461", "Bad Client (UE) IMSI 6"),
-		flag.String("badimsi7", "123456789123462", "Bad Client (UE) IMSI 7"),
-		flag.String("badimsi8", "123456789123463", "Bad Client (UE) IMSI 8"),
-		flag.String("badimsi9", "123456789123464", "Bad Client (UE) IMSI 9"),
-		flag.String("badimsi10", "123456789123465", "Bad Client (UE) IMSI 10"),
-		flag.String("badimsi11", "123456789123466", "Bad Client (UE) IMSI 11"),
-		flag.String("badimsi12", "123456789123467", "Bad Client (UE) IMSI 12"),
-	}
-
-	mixUeIMSIs = []*string{
-		flag.String("miximsi1", "001010123456789", "Client (UE) IMSI 1"),
-		flag.String("miximsi7", "123456789123456", "Bad Client (UE) IMSI 1"),
-		flag.String("miximsi2", "208920100001100", "Client (UE) IMSI 2"),
-		flag.String("miximsi8", "123456789123457", "Bad Client (UE) IMSI 2"),
-		flag.String("miximsi3", "208920100001101", "Client (UE) IMSI 3"),
-		flag.String("miximsi9", "123456789123458", "Bad Client (UE) IMSI 3"),
-		flag.String("miximsi4", "208920100001102", "Client (UE) IMSI 4"),
-		flag.String("miximsi10", "123456789123459", "Bad Client (UE) IMSI 4"),
-		flag.String("miximsi5", "208920100001103", "Client (UE) IMSI 5"),
-		flag.String("miximsi11", "123456789123460", "Bad Client (UE) IMSI 5"),
-		flag.String("miximsi6", "208920100001104", "Client (UE) IMSI 6"),
-		flag.String("miximsi12", "123456789123461", "Bad Client (UE) IMSI 6"),
-	}
+	// imsi sources of the built-in tests, see IMSISource for the syntax
+	// mix_imsis may refer to the other two as good and bad
+	goodIMSIs = flag.String("imsis",
+		"001010123456789,208920100001100,208920100001101,208920100001102,208920100001103,208920100001104,"+
+			"208920100001105,208920100001106,208920100001107,208920100001108,208920100001109,208920100001111",
+		"Client (UE) IMSIs: list, range, random:range, MCC/MNC/MSIN pattern or mix")
+	badIMSIs = flag.String("bad_imsis", "123456789123456-123456789123467", "Bad Client (UE) IMSIs")
+	mixIMSIs = flag.String("mix_imsis", "ordered:good:1,bad:1", "Mixture of good and bad Client (UE) IMSIs")
 
 	loadTestRequestNums = []int{10, 100, 500, 1000, 3000, 6000}
 )
@@ -99,145 +144,329 @@ var (
 // received channel to put into ULR handler
 var received = make(chan ReceivedResult)
 
+// keys to validate the E-UTRAN vectors of AIAs with, nil if not configured
+var authKeys *MilenageKeys
+
 func main() {
-	var i int
-	var cfgs [2]*sm.Settings
-	var conns [2]diam.Conn
+	var sc *Scenario
+	var err error
 
-	var successes, failures int
-	var duration time.Duration
+	flag.Parse()
 
-	log.Printf("Begin Connection...\n")
+	handleSignals()
+	if *metricsAddr != "" {
+		startMetrics(*metricsAddr)
+	}
 
-	// connect the mme's to the hss's
-	// 2 hss' is the current pattern
-	for i = 0; i < 2; i++ {
-		cfgs[i] = &sm.Settings{
-			OriginHost:       datatype.DiameterIdentity(*hosts[i]),
-			OriginRealm:      datatype.DiameterIdentity(*realm),
-			OriginStateID:    datatype.Unsigned32(time.Now().Unix()),
-			VendorID:         datatype.Unsigned32(*vendorID),
-			ProductName:      "go-diameter-s6a",
-			FirmwareRevision: 1,
-			HostIPAddresses: []datatype.Address{
-				datatype.Address(net.ParseIP("127.0.0.1")),
-			},
-		}
+	authKeys, err = parseMilenageKeys(*ki, *opc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idrAnswerCfg, err := parseAnswerConfig(*idrAnswer, *idrDelay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dsrAnswerCfg, err := parseAnswerConfig(*dsrAnswer, *dsrDelay)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		// Create the state machine (it's a diam.ServeMux) and client.
-		mux := sm.New(cfgs[i])
-
-		cli := &sm.Client{
-			Dict:               dict.Default,
-			Handler:            mux,
-			MaxRetransmits:     *retries,
-			RetransmitInterval: time.Second,
-			EnableWatchdog:     *watchdog != 0,
-			WatchdogInterval:   time.Duration(*watchdog) * time.Second,
-			SupportedVendorID: []*diam.AVP{
-				diam.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(*vendorID)),
-			},
-			VendorSpecificApplicationID: []*diam.AVP{
-				diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
-					AVP: []*diam.AVP{
-						diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(*appID)),
-						diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(*vendorID)),
-					},
-				}),
-			},
+	if *subscriberFile != "" {
+		if err = loadSubscribers(*subscriberFile); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		// Set message handlers.
-		mux.HandleIdx(
-			diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.UpdateLocation, Request: false},
-			handleUpdateLocationAnswer(received))
-
-		// Print error reports.
-		go printErrors(mux.ErrorReports())
-
-		conn, err := cli.DialNetwork(*networkType, *addrs[i], handleCEAClient)
+	// the built-in test sequence, unless a scenario file says otherwise
+	if *scenarioFile != "" {
+		sc, err = loadScenario(*scenarioFile)
 		if err != nil {
-			log.Printf("failed to connect mme %d\n", i)
-			// log.Fatal(err)
+			log.Fatalf("failed to load scenario %s: %s", *scenarioFile, err)
+		}
+	} else {
+		var profile *LoadProfile
+		if *profileSpec != "" {
+			if profile, err = parseLoadProfile(*profileSpec); err != nil {
+				log.Fatal(err)
+			}
+		}
+		sc = defaultScenario(profile)
+		if err = sc.validate(); err != nil {
+			log.Fatal(err)
 		}
-		log.Printf("connected to %s\n", *addrs[i])
-		conns[i] = conn
 	}
 
+	log.Printf("Begin Connection...\n")
+
+	// connect the mme's to the hss's and eir's of the scenario
+	peers := connectPeers(sc.Peers,
+		func(mux *sm.StateMachine, cfg *sm.Settings) {
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.UpdateLocation, Request: false},
+				handleUpdateLocationAnswer(received))
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.AuthenticationInformation, Request: false},
+				handleAuthenticationInformationAnswer(received))
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.PurgeUE, Request: false},
+				handlePurgeUEAnswer(received))
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.Notify, Request: false},
+				handleNotifyAnswer(received))
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.CancelLocation, Request: true},
+				handleCancelLocationRequest(cfg))
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: InsertSubscriberData, Request: true},
+				handleInsertSubscriberDataRequest(cfg, idrAnswerCfg))
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: DeleteSubscriberData, Request: true},
+				handleDeleteSubscriberDataRequest(cfg, dsrAnswerCfg))
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: diam.TGPP_S6A_APP_ID, Code: diam.Reset, Request: true},
+				handleResetRequest(cfg))
+			mux.HandleIdx(disconnectPeerAnswerIdx, handleDisconnectPeerAnswer(received))
+		},
+		func(mux *sm.StateMachine, cfg *sm.Settings) {
+			mux.HandleIdx(
+				diam.CommandIndex{AppID: TGPP_S13_APP_ID, Code: MEIdentityCheck, Request: false},
+				handleMEIdentityCheckAnswer(received))
+			mux.HandleIdx(disconnectPeerAnswerIdx, handleDisconnectPeerAnswer(received))
+		})
+
 	log.Printf("Connected\n")
 	log.Printf("Begin Tests...\n")
 
-	// run load tests with 1 single imsi
-	for i := 0; i < len(loadTestRequestNums); i++ {
-		successes, failures, duration = runTest(
-			loadTest(conns[0], cfgs[0]), []*string{ueIMSIs[0]}, loadTestRequestNums[i], 1, false)
-
-		printResults(i,
-			"Load Testing 1 HSS Results with "+strconv.Itoa(loadTestRequestNums[i])+" requests",
-			successes, failures, loadTestRequestNums[i], duration)
-	}
-
-	// 2 hss test - success
-	successes, failures, duration = runTest(
-		twoHSSTest(conns[0], conns[1], cfgs[0], cfgs[1]),
-		ueIMSIs, len(ueIMSIs), 2, false)
-	printResults(1, "2 HSS Testing - success cases",
-		successes, failures, len(ueIMSIs)*2, duration)
-
-	// 2 hss test - failure
-	successes, failures, duration = runTest(
-		twoHSSTest(conns[0], conns[1], cfgs[0], cfgs[1]),
-		badUeIMSIs, len(badUeIMSIs), 2, false)
-	printResults(2, "2 HSS Testing - failure cases",
-		successes, failures, len(badUeIMSIs)*2, duration)
-
-	// 2 hss test - mixture
-	successes, failures, duration = runTest(
-		twoHSSTest(conns[0], conns[1], cfgs[0], cfgs[1]),
-		mixUeIMSIs, len(mixUeIMSIs), 2, false)
-	printResults(3, "2 HSS Testing - mixture cases",
-		successes, failures, len(mixUeIMSIs)*2, duration)
+	passed := runScenario(sc, peers)
+	if err := writeResults(); err != nil {
+		log.Printf("failed to write results: %s", err)
+		passed = false
+	}
 
+	// let the hss know we are going instead of leaving it to find out from the transport
+	drainTransactions(*drainTimeout)
+	disconnectPeers(peers)
+	if isShuttingDown() {
+		log.Printf("Testing interrupted.")
+		os.Exit(1)
+	}
+	if !passed {
+		log.Printf("Testing Completed with failed expectations.")
+		os.Exit(1)
+	}
 	log.Printf("Testing Completed. Goodbye :)")
 }
 
+// the settings of an mme, its Origin-State-Id is when it started
+func newSettings(host string) *sm.Settings {
+	return &sm.Settings{
+		OriginHost:       datatype.DiameterIdentity(host),
+		OriginRealm:      datatype.DiameterIdentity(*realm),
+		OriginStateID:    datatype.Unsigned32(time.Now().Unix()),
+		VendorID:         datatype.Unsigned32(*vendorID),
+		ProductName:      "go-diameter-s6a",
+		FirmwareRevision: 1,
+		HostIPAddresses: []datatype.Address{
+			datatype.Address(net.ParseIP("127.0.0.1")),
+		},
+	}
+}
+
+// connect an mme to a diameter peer (an hss, or an eir)
+// return: the connection, nil if it failed
+// parameters:
+// - addr: address of the peer in form of ip:port
+// - cfg: settings of the mme, see newSettings
+// - app: the AuthApplicationID advertised in the CER
+// - setHandlers: sets the message handlers on the state machine of the connection
+func connect(addr string, cfg *sm.Settings, app uint32,
+	setHandlers func(*sm.StateMachine, *sm.Settings)) diam.Conn {
+	// Create the state machine (it's a diam.ServeMux) and client.
+	mux := sm.New(cfg)
+
+	cli := &sm.Client{
+		Dict:               dict.Default,
+		Handler:            mux,
+		MaxRetransmits:     *retries,
+		RetransmitInterval: time.Second,
+		// the peer keeps the watchdog, to tell a suspect peer from a closed one
+		EnableWatchdog: false,
+		SupportedVendorID: []*diam.AVP{
+			diam.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(*vendorID)),
+		},
+		VendorSpecificApplicationID: []*diam.AVP{
+			diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+				AVP: []*diam.AVP{
+					diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(app)),
+					diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(*vendorID)),
+				},
+			}),
+		},
+	}
+
+	// Set message handlers.
+	setHandlers(mux, cfg)
+
+	// Print error reports.
+	go printErrors(mux.ErrorReports())
+
+	conn, err := cli.DialNetwork(*networkType, addr, handleCEAClient)
+	if err != nil {
+		log.Printf("failed to connect mme %s to %s\n", cfg.OriginHost, addr)
+		// log.Fatal(err)
+		return nil
+	}
+	log.Printf("connected to %s\n", addr)
+	return conn
+}
+
 func printErrors(ec <-chan *diam.ErrorReport) {
 	for err := range ec {
 		log.Println(err)
 	}
 }
 
-// loadTest() is an example of a testFunc that will be passed into the runTest method.
+// loadTest() is an example of a testFunc that will be passed into the runScheduledTest method.
 // return: a function that takes in an []int of sids, an imsi, and two sent channels (one good, one error)
 // parameters: the connection and cfg of the hss
 // the use case is to send one imsi to multiple hss', but since this is a load test, there is
 // only one request to an hss
-func loadTest(connection diam.Conn, cfgs *sm.Settings) func([]int, *string, chan int, chan struct{}) {
-	return func(sids []int, imsi *string, sent chan int, sentErr chan struct{}) {
+func loadTest(connection diam.Conn, cfgs *sm.Settings) func([]int, *string, chan int, chan int) {
+	return func(sids []int, imsi *string, sent chan int, sentErr chan int) {
 		sendULR(connection, cfgs, imsi, sids[0], sent, sentErr)
 	}
 }
 
-// twoHSSTest() is an example of a testFunc that will be passed into the runTest method.
+// authLoadTest() is the AIR counterpart of loadTest()
+// return: a function that takes in an []int of sids, an imsi, and two sent channels (one good, one error)
+// parameters: the connection and cfg of the hss
+// sends a single AIR, which is what a real attach hits first
+func authLoadTest(connection diam.Conn, cfgs *sm.Settings) func([]int, *string, chan int, chan int) {
+	return func(sids []int, imsi *string, sent chan int, sentErr chan int) {
+		sendAIR(connection, cfgs, imsi, sids[0], sent, sentErr)
+	}
+}
+
+// resyncTest() is a testFunc for the HSS's SQN recovery
+// return: a function that takes in an []int of sids, an imsi, and two sent channels (one good, one error)
+// parameters: the connection and cfg of the hss, the SQN the mock UE claims to be at
+// the AUTS is built with the imsi's keys from the subscriber file, or -ki/-opc
+// sends an AIR, builds an AUTS for sqnMS from the RAND of the first vector that comes
+// back and sends it in a follow-up AIR, whose vectors must all be above sqnMS
+func resyncTest(connection diam.Conn, cfgs *sm.Settings, sqnMS uint64) func([]int, *string, chan int, chan int) {
+	return func(sids []int, imsi *string, sent chan int, sentErr chan int) {
+		answer := awaitAIA(sids[0])
+		sendAIR(connection, cfgs, imsi, sids[0], sent, sentErr)
+
+		var aia AIA
+		select {
+		case a, ok := <-answer:
+			if !ok {
+				log.Printf("no AIA to resynchronise imsi %s with", *imsi)
+				return
+			}
+			aia = a
+		case <-time.After(20 * time.Second):
+			log.Printf("timed out waiting for AIA to resynchronise")
+			forgetAIA(sids[0])
+			return
+		}
+		if len(aia.AI.EUtranVectors) == 0 {
+			log.Printf("no vector to resynchronise with for imsi %s", *imsi)
+			return
+		}
+
+		challenge := []byte(aia.AI.EUtranVectors[0].RAND)
+		keys := subscribersByIMSI[*imsi].keys()
+		if keys == nil {
+			log.Printf("no keys to resynchronise imsi %s with", *imsi)
+			return
+		}
+		auts := keys.generateAUTS(challenge, sqnToBytes(sqnMS))
+		expectResync(sids[1], sqnMS)
+		sendResyncAIR(connection, cfgs, imsi, sids[1], append(challenge, auts...), sent, sentErr)
+	}
+}
+
+// twoHSSTest() is an example of a testFunc that will be passed into the runScheduledTest method.
 // return: a function that takes in an []int of sids, an imsi, and two sent channels (one good, one error)
 // parameters: two hss connections and two hss cfgs
 // sends a ULR to the first hss, wait 2 seconds, and then send a ULR with the same imsi to a 2nd HSS
 // different sids so each request can be tracked in our tests
 func twoHSSTest(hss1 diam.Conn, hss2 diam.Conn,
-	cfg1 *sm.Settings, cfg2 *sm.Settings) func([]int, *string, chan int, chan struct{}) {
-	return func(sids []int, imsi *string, sent chan int, sentErr chan struct{}) {
+	cfg1 *sm.Settings, cfg2 *sm.Settings) func([]int, *string, chan int, chan int) {
+	return func(sids []int, imsi *string, sent chan int, sentErr chan int) {
 		sendULR(hss1, cfg1, imsi, sids[0], sent, sentErr)
 		time.Sleep(2 * time.Second)
 		sendULR(hss2, cfg2, imsi, sids[1], sent, sentErr)
 	}
 }
 
+// notifyTest() is an example of a testFunc that will be passed into the runScheduledTest method.
+// return: a function that takes in an []int of sids, an imsi, and two sent channels (one good, one error)
+// parameters: the connection and cfg of the hss
+// registers the imsi with a ULR and then reports its PDN GW with a NOR, the hss only
+// stores the dynamic PDN GW of a registered subscriber
+func notifyTest(connection diam.Conn, cfgs *sm.Settings) func([]int, *string, chan int, chan int) {
+	return func(sids []int, imsi *string, sent chan int, sentErr chan int) {
+		sendULR(connection, cfgs, imsi, sids[0], sent, sentErr)
+		time.Sleep(2 * time.Second)
+		sendNOR(connection, cfgs, imsi, sids[1], sent, sentErr)
+	}
+}
+
+// twoHSSPurgeTest() is an example of a testFunc that will be passed into the runScheduledTest method.
+// return: a function that takes in an []int of sids, an imsi, and two sent channels (one good, one error)
+// parameters: two hss connections and two hss cfgs
+// registers the imsi with a ULR to the first hss, wait 2 seconds, and then purges it with a PUR
+// to the 2nd HSS, which only succeeds if the 2nd HSS sees the registration made on the first
+func twoHSSPurgeTest(hss1 diam.Conn, hss2 diam.Conn,
+	cfg1 *sm.Settings, cfg2 *sm.Settings) func([]int, *string, chan int, chan int) {
+	return func(sids []int, imsi *string, sent chan int, sentErr chan int) {
+		sendULR(hss1, cfg1, imsi, sids[0], sent, sentErr)
+		time.Sleep(2 * time.Second)
+		sendPUR(hss2, cfg2, imsi, sids[1], sent, sentErr)
+	}
+}
+
+// eirTest() is an example of a testFunc that will be passed into the runScheduledTest method.
+// return: a function that takes in an []int of sids, an imei, and two sent channels (one good, one error)
+// parameters: the connection and cfg of the eir
+// unlike the hss tests, runScheduledTest is given imeis instead of imsis
+func eirTest(connection diam.Conn, cfgs *sm.Settings) func([]int, *string, chan int, chan int) {
+	return func(sids []int, imei *string, sent chan int, sentErr chan int) {
+		sendECR(connection, cfgs, imei, sids[0], sent, sentErr)
+	}
+}
+
 // print the results of the test
-func printResults(index int, testName string, successes int, failures int,
-	total int, duration time.Duration) {
+// with the latency stats of all answers, per peer and per procedure, and the latency histogram
+func printResults(index int, testName string, result TestResult) {
 	log.Printf("%d. %s:", index, testName)
-	log.Printf("   Successes: %d\n", successes)
-	log.Printf("   Failures: %d\n", failures)
-	log.Printf("   Missing: %d\n", total-(successes+failures))
-	log.Printf("   Finished in: %v\n", duration)
+	log.Printf("   Successes: %d\n", result.Successes)
+	log.Printf("   Failures: %d\n", result.Failures)
+	log.Printf("   Missing: %d\n", result.Total-(result.Successes+result.Failures))
+	log.Printf("   Timed Out: %d\n", result.TimedOut)
+	log.Printf("   Finished in: %v\n", result.Duration)
+	if len(result.Answers) == 0 {
+		return
+	}
+	log.Printf("   Latency: %s\n", newLatencyStats(result.Latencies()))
+	byPeer, peers := groupLatencies(result.Answers, func(a Answer) string { return a.Peer })
+	for _, peer := range peers {
+		log.Printf("      %s: %s\n", peer, newLatencyStats(byPeer[peer]))
+	}
+	byProcedure, procedures := groupLatencies(result.Answers, func(a Answer) string { return a.Procedure })
+	for _, procedure := range procedures {
+		log.Printf("      %s: %s\n", procedure, newLatencyStats(byProcedure[procedure]))
+	}
+	log.Printf("   Latency Histogram:\n")
+	newHistogram(result.Latencies()).print("      ")
+}
+
+// print how an open loop test kept up with its rate
+// latencies are measured from when each request was scheduled, not when it went out
+func printRateResults(rate float64, result TestResult) {
+	log.Printf("   Target Rate: %.1f/s\n", rate)
+	log.Printf("   Sent: %d\n", result.Sent)
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"github.com/fiorix/go-diameter/diam/sm"
+	"github.com/fiorix/go-diameter/diam/sm/smpeer"
+)
+
+var (
+	equipmentStatusLock sync.Mutex
+	// Equipment-Status name to how many ECAs carried it
+	equipmentStatuses = make(map[string]int)
+)
+
+// Create & send ME-Identity-Check Request
+// imei is an IMEI, or an IMEISV (16 digits) that is split into IMEI and Software-Version
+// sent back the sid through the sent channel
+func sendECR(c diam.Conn, cfg *sm.Settings, imei *string, randomVal int, sent chan int, sentErr chan int) {
+	meta, ok := smpeer.FromContext(c.Context())
+	if !ok {
+		sentErr <- randomVal
+		return
+	}
+	if err := validateIMEI(*imei); err != nil {
+		log.Printf("not sending ECR: %s", err)
+		sentErr <- randomVal
+		return
+	}
+	terminal := &diam.GroupedAVP{}
+	if len(*imei) == 16 {
+		terminal.AddAVP(diam.NewAVP(avp.IMEI, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.UTF8String((*imei)[:14])))
+		terminal.AddAVP(diam.NewAVP(avp.SoftwareVersion, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.UTF8String((*imei)[14:])))
+	} else {
+		terminal.AddAVP(diam.NewAVP(avp.IMEI, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.UTF8String(*imei)))
+	}
+
+	sid := sessionIDFor(randomVal, string(cfg.OriginHost))
+	m := diam.NewRequest(MEIdentityCheck, TGPP_S13_APP_ID, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sid))
+	m.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(1))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, meta.OriginRealm)
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, meta.OriginHost)
+	m.NewAVP(avp.TerminalInformation, avp.Vbit|avp.Mbit, uint32(*vendorID), terminal)
+	// log.Printf("\nSending ECR to %s\n%s\n", c.RemoteAddr(), m)
+	err := sendRequest(c, m, randomVal, "ECR")
+	if err != nil {
+		sentErr <- randomVal
+	} else {
+		sent <- randomVal
+	}
+}
+
+// Handle ECA
+// classifies the Equipment-Status and send back the result through the ReceivedResult channel
+func handleMEIdentityCheckAnswer(received chan ReceivedResult) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received ME-Identity-Check Answer from %s\n%s\n", c.RemoteAddr(), m)
+		countAnswer(c, m, "ECR")
+		sid, ok := matchAnswer(m)
+		if !ok {
+			return
+		}
+		var eca ECA
+		err := m.Unmarshal(&eca)
+		if err != nil {
+			log.Printf("ECA Unmarshal failed: %s", err)
+			sendResult(received, ReceivedResult{sid, -2, c.RemoteAddr(), "ECR", answerResult(m)})
+		} else {
+			equipmentStatusLock.Lock()
+			equipmentStatuses[equipmentStatusName(eca.EquipmentStatus)]++
+			equipmentStatusLock.Unlock()
+			if validateECAResponse(eca) == 1 {
+				sendResult(received, ReceivedResult{sid, 0, c.RemoteAddr(), "ECR", answerResult(m)})
+			} else {
+				sendResult(received, ReceivedResult{sid, -1, c.RemoteAddr(), "ECR", answerResult(m)})
+			}
+			// log.Printf("Unmarshaled EC Answer:\n%#+v\n", eca)
+		}
+	}
+}
+
+// an ECA is a success if the eir knew the equipment, whatever list it is on
+func validateECAResponse(eca ECA) int {
+	if eca.ResultCode != 0x7d1 || eca.EquipmentStatus == nil {
+		return 0
+	}
+	return 1
+}
+
+func equipmentStatusName(status *int32) string {
+	if status == nil {
+		return "MISSING"
+	}
+	switch *status {
+	case 0:
+		return "WHITELISTED"
+	case 1:
+		return "BLACKLISTED"
+	case 2:
+		return "GREYLISTED"
+	}
+	return "UNKNOWN(" + strconv.Itoa(int(*status)) + ")"
+}
+
+func resetEquipmentStatuses() {
+	equipmentStatusLock.Lock()
+	equipmentStatuses = make(map[string]int)
+	equipmentStatusLock.Unlock()
+}
+
+// print how many of the checked imeis are on each list
+func printEquipmentStatuses() {
+	equipmentStatusLock.Lock()
+	defer equipmentStatusLock.Unlock()
+	for status, count := range equipmentStatuses {
+		log.Printf("   %s: %d\n", status, count)
+	}
+}
+
+// split the comma separated -imeis flag, leaving out the entries that are not imeis
+func parseIMEIs(list string) []*string {
+	var parsed []*string
+	for _, field := range strings.Split(list, ",") {
+		imei := strings.TrimSpace(field)
+		if imei == "" {
+			continue
+		}
+		if err := validateIMEI(imei); err != nil {
+			log.Printf("skipping %s", err)
+			continue
+		}
+		parsed = append(parsed, &imei)
+	}
+	return parsed
+}
+
+// an IMEI is 14 digits, or 15 with its check digit, and an IMEISV 16 (TS 23.003 6.2)
+func validateIMEI(imei string) error {
+	if len(imei) < 14 || len(imei) > 16 {
+		return errors.New("IMEI " + imei + ": must be 14-15 digits or an IMEISV of 16")
+	}
+	for i := 0; i < len(imei); i++ {
+		if imei[i] < '0' || imei[i] > '9' {
+			return errors.New("IMEI " + imei + ": must be digits only")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// live counters and latency histograms for long soak tests, served in the prometheus
+// text format on -metrics_addr:
+// - mock_mme_requests_sent_total{peer,procedure}
+// - mock_mme_send_errors_total{peer,procedure}
+// - mock_mme_answers_total{peer,procedure,origin_host,result_code,experimental_result_code}
+// - mock_mme_timeouts_total: requests not answered within -request_timeout
+// - mock_mme_answer_anomalies_total{kind}: see transactionTable
+// - mock_mme_retransmissions_total{kind}: see retransmission
+// - mock_mme_peer_state_changes_total{peer,state}: see Peer
+// - mock_mme_rerouted_total{peer,to}: requests for a peer that was down sent to another one
+// - mock_mme_latency_seconds{peer,procedure,origin_host}: histogram of answered requests
+type metricsRegistry struct {
+	lock     sync.Mutex
+	counters map[string]map[string]float64
+	// labels to histogram, of mock_mme_latency_seconds
+	latencies map[string]*latencyHistogram
+	// peer address to the Origin-Host it answers with
+	originHosts map[string]string
+}
+
+type latencyHistogram struct {
+	// count of latencies up to each of latencyBuckets, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// upper bounds of the latency histogram buckets in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metrics = metricsRegistry{
+	counters:    make(map[string]map[string]float64),
+	latencies:   make(map[string]*latencyHistogram),
+	originHosts: make(map[string]string),
+}
+
+// what each counter counts, for its HELP line
+var counterHelp = map[string]string{
+	"mock_mme_requests_sent_total":      "Requests sent to the peers.",
+	"mock_mme_send_errors_total":        "Requests that could not be sent.",
+	"mock_mme_answers_total":            "Answers received, by Result-Code and Experimental-Result-Code.",
+	"mock_mme_timeouts_total":           "Requests a test gave up waiting for an answer to.",
+	"mock_mme_answer_anomalies_total":   "Answers that were late, duplicate, unsolicited or had a mismatched Session-Id or End-to-End ID.",
+	"mock_mme_retransmissions_total":    "Requests retransmitted and how the answers to them came back.",
+	"mock_mme_peer_state_changes_total": "Times a peer went into a state: closed, wait_cea, open or suspect.",
+	"mock_mme_rerouted_total":           "Requests sent to another peer of the application while theirs was down.",
+}
+
+// serve /metrics on addr in the background
+func startMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+	go func() {
+		log.Printf("serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server failed: %s", err)
+		}
+	}()
+}
+
+// label values in the order of names, e.g. labels("peer", addr, "procedure", "ULR")
+func labels(nameValues ...string) string {
+	pairs := make([]string, 0, len(nameValues)/2)
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		pairs = append(pairs, nameValues[i]+`="`+escapeLabel(nameValues[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (r *metricsRegistry) add(name string, labels string, v float64) {
+	r.lock.Lock()
+	series, ok := r.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		r.counters[name] = series
+	}
+	series[labels] += v
+	r.lock.Unlock()
+}
+
+func peerName(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// count a request sent to c, or that failed to be sent if err is not nil
+func countSent(c diam.Conn, procedure string, err error) {
+	name := "mock_mme_requests_sent_total"
+	if err != nil {
+		name = "mock_mme_send_errors_total"
+	}
+	metrics.add(name, labels("peer", peerName(c.RemoteAddr()), "procedure", procedure), 1)
+}
+
+// count an answer by its result codes, and remember the Origin-Host of its peer
+func countAnswer(c diam.Conn, m *diam.Message, procedure string) {
+	peer := peerName(c.RemoteAddr())
+	originHost, resultCode, experimentalResultCode := answerCodes(m)
+	metrics.add("mock_mme_answers_total", labels("peer", peer, "procedure", procedure,
+		"origin_host", originHost, "result_code", resultCode,
+		"experimental_result_code", experimentalResultCode), 1)
+	if originHost != "" {
+		metrics.lock.Lock()
+		metrics.originHosts[peer] = originHost
+		metrics.lock.Unlock()
+	}
+}
+
+// the Origin-Host, Result-Code and Experimental-Result-Code of an answer, empty if absent
+func answerCodes(m *diam.Message) (string, string, string) {
+	originHost, resultCode, experimentalResultCode := "", "", ""
+	code := func(a *diam.AVP) string {
+		if v, ok := a.Data.(datatype.Unsigned32); ok {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+		return ""
+	}
+	if a, err := m.FindAVP(avp.OriginHost, 0); err == nil {
+		if v, ok := a.Data.(datatype.DiameterIdentity); ok {
+			originHost = string(v)
+		}
+	}
+	if a, err := m.FindAVP(avp.ResultCode, 0); err == nil {
+		resultCode = code(a)
+	}
+	path := []interface{}{avp.ExperimentalResult, avp.ExperimentalResultCode}
+	if avps, err := m.FindAVPsWithPath(path, 0); err == nil && len(avps) != 0 {
+		experimentalResultCode = code(avps[0])
+	}
+	return originHost, resultCode, experimentalResultCode
+}
+
+func countTimeouts(n int) {
+	metrics.add("mock_mme_timeouts_total", "", float64(n))
+}
+
+// add the latency of an answered request to the histogram of its peer and procedure
+func observeLatency(peer string, procedure string, latency time.Duration) {
+	r := &metrics
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := labels("peer", peer, "procedure", procedure, "origin_host", r.originHosts[peer])
+	h, ok := r.latencies[key]
+	if !ok {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		r.latencies[key] = h
+	}
+	seconds := latency.Seconds()
+	for i := 0; i < len(latencyBuckets); i++ {
+		if seconds <= latencyBuckets[i] {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// every series in the prometheus text format, sorted so scrapes diff nicely
+func (r *metricsRegistry) write(w io.Writer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	series := func(name string, labels string) string {
+		if labels == "" {
+			return name
+		}
+		return name + "{" + labels + "}"
+	}
+	var names []string
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, counterHelp[name], name)
+		var keys []string
+		for key := range r.counters[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s %v\n", series(name, key), r.counters[name][key])
+		}
+	}
+
+	if len(r.latencies) == 0 {
+		return
+	}
+	const name = "mock_mme_latency_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of answered requests.\n# TYPE %s histogram\n", name, name)
+	var keys []string
+	for key := range r.latencies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := r.latencies[key]
+		cumulative := uint64(0)
+		for i := 0; i < len(latencyBuckets); i++ {
+			cumulative += h.counts[i]
+			le := `le="` + strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64) + `"`
+			fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", key+","+le), cumulative)
+		}
+		fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", key+`,le="+Inf"`), h.count)
+		fmt.Fprintf(w, "%s %v\n", series(name+"_sum", key), h.sum)
+		fmt.Fprintf(w, "%s %d\n", series(name+"_count", key), h.count)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// a connection to a peer, only good for its address
+type addrConn struct {
+	diam.Conn
+	addr string
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+// empty the metrics for a test
+// return: puts back what was there before
+func emptyMetrics() func() {
+	metrics.lock.Lock()
+	counters, latencies, originHosts := metrics.counters, metrics.latencies, metrics.originHosts
+	metrics.counters = make(map[string]map[string]float64)
+	metrics.latencies = make(map[string]*latencyHistogram)
+	metrics.originHosts = make(map[string]string)
+	metrics.lock.Unlock()
+	return func() {
+		metrics.lock.Lock()
+		metrics.counters, metrics.latencies, metrics.originHosts = counters, latencies, originHosts
+		metrics.lock.Unlock()
+	}
+}
+
+func TestMetricsWrite(t *testing.T) {
+	defer emptyMetrics()()
+	hss := addrConn{addr: "127.0.0.1:3868"}
+
+	countSent(hss, "ULR", nil)
+	countSent(hss, "ULR", nil)
+	countSent(hss, "AIR", errors.New("closed"))
+	ula := diam.NewRequest(diam.UpdateLocation, diam.TGPP_S6A_APP_ID, dict.Default).Answer(5001)
+	ula.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("hss.test"))
+	ula.NewAVP(avp.ExperimentalResult, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415)),
+		diam.NewAVP(avp.ExperimentalResultCode, avp.Mbit, 0, datatype.Unsigned32(5420)),
+	}})
+	countAnswer(hss, ula, "ULR")
+	observeLatency("127.0.0.1:3868", "ULR", 3*time.Millisecond)
+	observeLatency("127.0.0.1:3868", "ULR", 20*time.Second)
+	countTimeouts(1)
+
+	var b bytes.Buffer
+	metrics.write(&b)
+	want := `# HELP mock_mme_answers_total Answers received, by Result-Code and Experimental-Result-Code.
+# TYPE mock_mme_answers_total counter
+mock_mme_answers_total{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",result_code="5001",experimental_result_code="5420"} 1
+# HELP mock_mme_requests_sent_total Requests sent to the peers.
+# TYPE mock_mme_requests_sent_total counter
+mock_mme_requests_sent_total{peer="127.0.0.1:3868",procedure="ULR"} 2
+# HELP mock_mme_send_errors_total Requests that could not be sent.
+# TYPE mock_mme_send_errors_total counter
+mock_mme_send_errors_total{peer="127.0.0.1:3868",procedure="AIR"} 1
+# HELP mock_mme_timeouts_total Requests a test gave up waiting for an answer to.
+# TYPE mock_mme_timeouts_total counter
+mock_mme_timeouts_total 1
+# HELP mock_mme_latency_seconds Latency of answered requests.
+# TYPE mock_mme_latency_seconds histogram
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.001"} 0
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.0025"} 0
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.005"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.01"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.025"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.05"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.1"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.25"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="0.5"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="1"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="2.5"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="5"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="10"} 1
+mock_mme_latency_seconds_bucket{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test",le="+Inf"} 2
+mock_mme_latency_seconds_sum{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test"} 20.003
+mock_mme_latency_seconds_count{peer="127.0.0.1:3868",procedure="ULR",origin_host="hss.test"} 2
+`
+	if b.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, b.String())
+	}
+}
+
+func TestAnswerCodes(t *testing.T) {
+	cea := diam.NewRequest(diam.CapabilitiesExchange, 0, dict.Default).Answer(2001)
+	if host, result, experimental := answerCodes(cea); host != "" || result != "2001" || experimental != "" {
+		t.Errorf("Origin-Host %q Result-Code %q Experimental-Result-Code %q", host, result, experimental)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	got := labels("peer", "127.0.0.1:3868", "origin_host", "a\"b\\c\nd", "odd")
+	if want := `peer="127.0.0.1:3868",origin_host="a\"b\\c\nd"`; got != want {
+		t.Errorf("expected %s got %s", want, got)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Milenage keys of a subscriber, used to recompute what the HSS should have
+// put into each E-UTRAN vector (3GPP TS 35.206 and TS 33.401 Annex A.2)
+type MilenageKeys struct {
+	Ki  []byte
+	OPc []byte
+}
+
+// parse hex encoded Ki/OPc, both have to be 128 bits
+// return: nil keys if neither is given, since validation is optional
+func parseMilenageKeys(ki string, opc string) (*MilenageKeys, error) {
+	if ki == "" && opc == "" {
+		return nil, nil
+	}
+	k, err := hex.DecodeString(ki)
+	if err != nil || len(k) != 16 {
+		return nil, errors.New("Ki must be 32 hex characters")
+	}
+	o, err := hex.DecodeString(opc)
+	if err != nil || len(o) != 16 {
+		return nil, errors.New("OPc must be 32 hex characters")
+	}
+	return &MilenageKeys{k, o}, nil
+}
+
+// f1 and f1*: network and resynchronisation authentication codes
+// return: MAC-A, MAC-S
+func (keys *MilenageKeys) f1(rand []byte, sqn []byte, amf []byte) ([]byte, []byte) {
+	temp := keys.encrypt(xor(rand, keys.OPc))
+
+	in1 := make([]byte, 16)
+	copy(in1[0:6], sqn)
+	copy(in1[6:8], amf)
+	copy(in1[8:14], sqn)
+	copy(in1[14:16], amf)
+
+	// rotate by r1 = 64 bits, c1 is all zeros
+	out := keys.encrypt(xor(temp, rotate(xor(in1, keys.OPc), 8)))
+	out = xor(out, keys.OPc)
+	return out[0:8], out[8:16]
+}
+
+// f2, f3, f4, f5 and f5*
+// return: RES, CK, IK, AK, AK*
+func (keys *MilenageKeys) f2345(rand []byte) ([]byte, []byte, []byte, []byte, []byte) {
+	temp := keys.encrypt(xor(rand, keys.OPc))
+	in := xor(temp, keys.OPc)
+
+	// r2 = 0, c2 = 1
+	out2 := keys.out(in, 0, 1)
+	// r3 = 32, c3 = 2
+	out3 := keys.out(in, 4, 2)
+	// r4 = 64, c4 = 4
+	out4 := keys.out(in, 8, 4)
+	// r5 = 96, c5 = 8
+	out5 := keys.out(in, 12, 8)
+
+	return out2[8:16], out3, out4, out2[0:6], out5[0:6]
+}
+
+// one of the OUT2..OUT5 blocks, rotated by rot bytes with c as the last byte of the constant
+func (keys *MilenageKeys) out(in []byte, rot int, c byte) []byte {
+	x := rotate(in, rot)
+	x[15] ^= c
+	return xor(keys.encrypt(x), keys.OPc)
+}
+
+func (keys *MilenageKeys) encrypt(in []byte) []byte {
+	// Ki is checked to be 16 bytes in parseMilenageKeys
+	block, _ := aes.NewCipher(keys.Ki)
+	out := make([]byte, 16)
+	block.Encrypt(out, in)
+	return out
+}
+
+// KASME = KDF(CK || IK, FC=0x10, serving network id, SQN xor AK)
+func deriveKASME(ck []byte, ik []byte, plmn []byte, sqnXorAK []byte) []byte {
+	s := []byte{0x10}
+	s = append(s, plmn...)
+	s = append(s, 0x00, byte(len(plmn)))
+	s = append(s, sqnXorAK...)
+	s = append(s, 0x00, byte(len(sqnXorAK)))
+
+	mac := hmac.New(sha256.New, append(append([]byte{}, ck...), ik...))
+	mac.Write(s)
+	return mac.Sum(nil)
+}
+
+// recompute XRES, AUTN and KASME of an E-UTRAN vector from its RAND
+// the SQN is recovered from the AUTN since the HSS owns it
+// return: one line per field that does not match, empty if the vector is good
+func (keys *MilenageKeys) validateEUtranVector(v EUtranVector, plmn []byte) []string {
+	var mismatches []string
+	rand, xres, autn := []byte(v.RAND), []byte(v.XRES), []byte(v.AUTN)
+
+	res, ck, ik, ak, _ := keys.f2345(rand)
+	sqnXorAK := autn[0:6]
+	amf := autn[6:8]
+	sqn := xor(sqnXorAK, ak)
+	macA, _ := keys.f1(rand, sqn, amf)
+
+	// the HSS may send a truncated XRES, it is always a prefix of RES
+	if !bytes.HasPrefix(res, xres) {
+		mismatches = append(mismatches, fmt.Sprintf("XRES expected %x got %x", res, xres))
+	}
+	if !bytes.Equal(macA, autn[8:16]) {
+		mismatches = append(mismatches, fmt.Sprintf("AUTN MAC-A expected %x got %x", macA, autn[8:16]))
+	}
+	// E-UTRAN vectors must have the AMF separation bit set (TS 33.401 6.1.1)
+	if amf[0]&0x80 == 0 {
+		mismatches = append(mismatches, fmt.Sprintf("AUTN AMF %x does not have the separation bit set", amf))
+	}
+	kasme := deriveKASME(ck, ik, plmn, sqnXorAK)
+	if !bytes.Equal(kasme, []byte(v.KASME)) {
+		mismatches = append(mismatches, fmt.Sprintf("KASME expected %x got %x", kasme, []byte(v.KASME)))
+	}
+	return mismatches
+}
+
+func xor(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := 0; i < len(a); i++ {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// cyclic rotation of a 128 bit block to the left by n bytes
+func rotate(in []byte, n int) []byte {
+	out := make([]byte, 16)
+	for i := 0; i < 16; i++ {
+		out[i] = in[(i+n)%16]
+	}
+	return out
+}
+
+// AUTS = SQN_MS xor AK* || MAC-S, sent by the UE when the SQN of a vector is out of range
+// the resynchronisation AMF is always zero (TS 33.102 6.3.3)
+func (keys *MilenageKeys) generateAUTS(rand []byte, sqn []byte) []byte {
+	_, _, _, _, akStar := keys.f2345(rand)
+	_, macS := keys.f1(rand, sqn, []byte{0x00, 0x00})
+	return append(xor(sqn, akStar), macS...)
+}
+
+// recover the SQN the HSS used for a vector from its AUTN
+func (keys *MilenageKeys) sqnFromVector(v EUtranVector) []byte {
+	_, _, _, ak, _ := keys.f2345([]byte(v.RAND))
+	return xor([]byte(v.AUTN)[0:6], ak)
+}
+
+// 48 bit big endian SQN
+func sqnToBytes(sqn uint64) []byte {
+	b := make([]byte, 6)
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(sqn)
+		sqn >>= 8
+	}
+	return b
+}
+
+func sqnFromBytes(b []byte) uint64 {
+	var sqn uint64
+	for i := 0; i < len(b); i++ {
+		sqn = sqn<<8 | uint64(b[i])
+	}
+	return sqn
+}
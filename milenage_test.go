@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// the conformance test sets of TS 35.208 4.3, with OPc as it is given there
+var milenageTestSets = []struct {
+	k, rand, sqn, amf, opc string
+	f1, f1Star, f2, f3     string
+	f4, f5, f5Star         string
+}{
+	{
+		k: "465b5ce8b199b49faa5f0a2ee238a6bc", rand: "23553cbe9637a89d218ae64dae47bf35",
+		sqn: "ff9bb4d0b607", amf: "b9b9", opc: "cd63cb71954a9f4e48a5994e37a02baf",
+		f1: "4a9ffac354dfafb3", f1Star: "01cfaf9ec4e871e9", f2: "a54211d5e3ba50bf",
+		f3: "b40ba9a3c58b2a05bbf0d987b21bf8cb", f4: "f769bcd751044604127672711c6d3441",
+		f5: "aa689c648370", f5Star: "451e8beca43b",
+	},
+	{
+		k: "0396eb317b6d1c36f19c1c84cd6ffd16", rand: "c00d603103dcee52c4478119494202e8",
+		sqn: "fd8eef40df7d", amf: "af17", opc: "53c15671c60a4b731c55b4a441c0bde2",
+		f1: "5df5b31807e258b0", f1Star: "a8c016e51ef4a343", f2: "d3a628ed988620f0",
+		f3: "58c433ff7a7082acd424220f2b67c556", f4: "21a8c1f929702adb3e738488b9f5c5da",
+		f5: "c47783995f72", f5Star: "30f1197061c1",
+	},
+	{
+		k: "fec86ba6eb707ed08905757b1bb44b8f", rand: "9f7c8d021accf4db213ccff0c7f71a6a",
+		sqn: "9d0277595ffc", amf: "725c", opc: "1006020f0a478bf6b699f15c062e42b3",
+		f1: "9cabc3e99baf7281", f1Star: "95814ba2b3044324", f2: "8011c48c0c214ed2",
+		f3: "5dbdbb2954e8f3cde665b046179a5098", f4: "59a92d3b476a0443487055cf88b2307b",
+		f5: "33484dc2136b", f5Star: "deacdd848cc6",
+	},
+	{
+		k: "9e5944aea94b81165c82fbf9f32db751", rand: "ce83dbc54ac0274a157c17f80d017bd6",
+		sqn: "0b604a81eca8", amf: "9e09", opc: "a64a507ae1a2a98bb88eb4210135dc87",
+		f1: "74a58220cba84c49", f1Star: "ac2cc74a96871837", f2: "f365cd683cd92e96",
+		f3: "e203edb3971574f5a94b0d61b816345d", f4: "0c4524adeac041c4dd830d20854fc46b",
+		f5: "f0b9c08ad02e", f5Star: "6085a86c6f63",
+	},
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestMilenage(t *testing.T) {
+	for i, set := range milenageTestSets {
+		keys, err := parseMilenageKeys(set.k, set.opc)
+		if err != nil {
+			t.Fatalf("test set %d: %v", i+1, err)
+		}
+		rand := unhex(set.rand)
+		macA, macS := keys.f1(rand, unhex(set.sqn), unhex(set.amf))
+		res, ck, ik, ak, akStar := keys.f2345(rand)
+		got := []struct {
+			name        string
+			value, want []byte
+		}{
+			{"f1", macA, unhex(set.f1)},
+			{"f1*", macS, unhex(set.f1Star)},
+			{"f2", res, unhex(set.f2)},
+			{"f3", ck, unhex(set.f3)},
+			{"f4", ik, unhex(set.f4)},
+			{"f5", ak, unhex(set.f5)},
+			{"f5*", akStar, unhex(set.f5Star)},
+		}
+		for _, g := range got {
+			if !bytes.Equal(g.value, g.want) {
+				t.Errorf("test set %d: %s expected %x got %x", i+1, g.name, g.want, g.value)
+			}
+		}
+	}
+}
+
+// TS 35.208 has no KASME, these were computed separately with the KDF of TS 33.220 B.2
+// from the CK/IK and SQN xor AK of test sets 1 and 2
+func TestDeriveKASME(t *testing.T) {
+	tests := []struct {
+		set      int
+		plmn     string
+		sqnXorAK string
+		kasme    string
+	}{
+		{1, "00f110", "55f328b43577", "48579af8781c742d5120e6ed8ccac13193f38c53ab7aa69396f49ca6e1b0562d"},
+		{2, "02f801", "39f96cd9800f", "6489d1d63c705b249bdabbfa0af8128b6a099cec4a38a21e7fb654b71c40ab49"},
+	}
+	for _, test := range tests {
+		set := milenageTestSets[test.set-1]
+		kasme := deriveKASME(unhex(set.f3), unhex(set.f4), unhex(test.plmn), unhex(test.sqnXorAK))
+		if hex.EncodeToString(kasme) != test.kasme {
+			t.Errorf("test set %d: KASME expected %s got %x", test.set, test.kasme, kasme)
+		}
+	}
+}
+
+func TestValidateEUtranVector(t *testing.T) {
+	set := milenageTestSets[0]
+	keys, _ := parseMilenageKeys(set.k, set.opc)
+	plmn := unhex("00f110")
+	sqn, amf := unhex("000000000021"), unhex("8000")
+	rand := unhex(set.rand)
+	res, ck, ik, ak, _ := keys.f2345(rand)
+	macA, _ := keys.f1(rand, sqn, amf)
+	v := EUtranVector{
+		RAND:  datatype.OctetString(rand),
+		XRES:  datatype.OctetString(res[:4]),
+		AUTN:  datatype.OctetString(append(append(xor(sqn, ak), amf...), macA...)),
+		KASME: datatype.OctetString(deriveKASME(ck, ik, plmn, xor(sqn, ak))),
+	}
+	if m := keys.validateEUtranVector(v, plmn); len(m) != 0 {
+		t.Fatalf("good vector: %v", m)
+	}
+	if sqnFromBytes(keys.sqnFromVector(v)) != 0x21 {
+		t.Errorf("SQN expected 21 got %x", keys.sqnFromVector(v))
+	}
+
+	bad := v
+	bad.KASME = datatype.OctetString(make([]byte, 32))
+	bad.XRES = datatype.OctetString(unhex("00000000"))
+	if m := keys.validateEUtranVector(bad, plmn); len(m) != 2 {
+		t.Errorf("expected XRES and KASME mismatches, got %v", m)
+	}
+	// a vector without the separation bit is not an E-UTRAN one
+	amf = unhex("0000")
+	macA, _ = keys.f1(rand, sqn, amf)
+	bad = v
+	bad.AUTN = datatype.OctetString(append(append(xor(sqn, ak), amf...), macA...))
+	if m := keys.validateEUtranVector(bad, plmn); len(m) != 1 {
+		t.Errorf("expected an AMF mismatch, got %v", m)
+	}
+}
+
+func TestGenerateAUTS(t *testing.T) {
+	set := milenageTestSets[0]
+	keys, _ := parseMilenageKeys(set.k, set.opc)
+	rand, sqn := unhex(set.rand), unhex(set.sqn)
+	auts := keys.generateAUTS(rand, sqn)
+	_, macS := keys.f1(rand, sqn, unhex("0000"))
+	if !bytes.Equal(auts[:6], xor(sqn, unhex(set.f5Star))) || !bytes.Equal(auts[6:], macS) {
+		t.Errorf("AUTS %x", auts)
+	}
+}
+
+func TestSQNBytes(t *testing.T) {
+	for _, sqn := range []uint64{0, 0x21, 0xff9bb4d0b607, 1<<48 - 1} {
+		b := sqnToBytes(sqn)
+		if len(b) != 6 || sqnFromBytes(b) != sqn {
+			t.Errorf("SQN %x: %x", sqn, b)
+		}
+	}
+}
+
+func TestParseMilenageKeys(t *testing.T) {
+	if keys, err := parseMilenageKeys("", ""); keys != nil || err != nil {
+		t.Errorf("no keys: %v %v", keys, err)
+	}
+	for _, bad := range [][2]string{
+		{"465b5ce8b199b49faa5f0a2ee238a6", "cd63cb71954a9f4e48a5994e37a02baf"},
+		{"465b5ce8b199b49faa5f0a2ee238a6bc", ""},
+		{"465b5ce8b199b49faa5f0a2ee238a6bc", "zz63cb71954a9f4e48a5994e37a02baf"},
+	} {
+		if _, err := parseMilenageKeys(bad[0], bad[1]); err == nil {
+			t.Errorf("Ki %s OPc %s: expected an error", bad[0], bad[1])
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"github.com/fiorix/go-diameter/diam/sm"
+	"github.com/fiorix/go-diameter/diam/sm/smpeer"
+)
+
+// Create & send Notify Request
+// reports the PDN GW of *norAPN (-nor_pgw_host/-nor_pgw_addr) and the homogeneous support
+// of IMS voice over PS (-nor_ims_voice), sent back the sid through the sent channel
+func sendNOR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, sent chan int, sentErr chan int) {
+	meta, ok := smpeer.FromContext(c.Context())
+	if !ok {
+		sentErr <- randomVal
+		return
+	}
+	sid := sessionIDFor(randomVal, string(cfg.OriginHost))
+	m := diam.NewRequest(diam.Notify, diam.TGPP_S6A_APP_ID, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sid))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, meta.OriginRealm)
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, meta.OriginHost)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(*imsi))
+	m.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(0))
+	if pgw := pgwIdentity(); pgw != nil {
+		m.NewAVP(avp.MIP6AgentInfo, avp.Mbit, 0, pgw)
+	}
+	if *norContextID != 0 {
+		m.NewAVP(avp.ContextIdentifier, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.Unsigned32(*norContextID))
+	}
+	if *norAPN != "" {
+		m.NewAVP(avp.ServiceSelection, avp.Mbit, 0, datatype.UTF8String(*norAPN))
+	}
+	m.NewAVP(avp.NORFlags, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.Unsigned32(*norFlags))
+	if *norIMSVoice >= 0 {
+		m.NewAVP(avp.HomogeneousSupportofIMSVoiceOverPSSessions, avp.Vbit, uint32(*vendorID),
+			datatype.Enumerated(*norIMSVoice))
+	}
+	// log.Printf("\nSending NOR to %s\n%s\n", c.RemoteAddr(), m)
+	err := sendRequest(c, m, randomVal, "NOR")
+	if err != nil {
+		sentErr <- randomVal
+	} else {
+		sent <- randomVal
+	}
+}
+
+// MIP6-Agent-Info of the PDN GW, by address and/or by Diameter identity
+// return: nil if no PDN GW is configured
+func pgwIdentity() *diam.GroupedAVP {
+	pgw := &diam.GroupedAVP{}
+	if *norPGWAddr != "" {
+		pgw.AddAVP(diam.NewAVP(avp.MIPHomeAgentAddress, avp.Mbit, 0,
+			datatype.Address(net.ParseIP(*norPGWAddr))))
+	}
+	if *norPGWHost != "" {
+		pgw.AddAVP(diam.NewAVP(avp.MIPHomeAgentHost, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity(*norPGWRealm)),
+				diam.NewAVP(avp.DestinationHost, avp.Mbit, 0, datatype.DiameterIdentity(*norPGWHost)),
+			},
+		}))
+	}
+	if len(pgw.AVP) == 0 {
+		return nil
+	}
+	return pgw
+}
+
+// Handle NOA
+// send back the result through the ReceivedResult channel
+func handleNotifyAnswer(received chan ReceivedResult) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Notify Answer from %s\n%s\n", c.RemoteAddr(), m)
+		countAnswer(c, m, "NOR")
+		sid, ok := matchAnswer(m)
+		if !ok {
+			return
+		}
+		var noa NOA
+		err := m.Unmarshal(&noa)
+		if err != nil {
+			log.Printf("NOA Unmarshal failed: %s", err)
+			sendResult(received, ReceivedResult{sid, -2, c.RemoteAddr(), "NOR", answerResult(m)})
+		} else {
+			if validateNOAResponse(noa) == 1 {
+				sendResult(received, ReceivedResult{sid, 0, c.RemoteAddr(), "NOR", answerResult(m)})
+			} else {
+				sendResult(received, ReceivedResult{sid, -1, c.RemoteAddr(), "NOR", answerResult(m)})
+			}
+			// log.Printf("Unmarshaled NO Answer:\n%#+v\n", noa)
+		}
+	}
+}
+
+func validateNOAResponse(noa NOA) int {
+	if noa.ResultCode != 0x7d1 {
+		return 0
+	}
+	return 1
+}
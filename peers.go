@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+// states of the connection to a peer, RFC 6733 5.6 and the watchdog of RFC 3539 as a client
+// sees them
+const (
+	// no connection, connecting again after a backoff
+	PEER_CLOSED = "closed"
+	// connected, waiting for the CEA
+	PEER_WAIT_CEA = "wait_cea"
+	// requests go through
+	PEER_OPEN = "open"
+	// a DWR went unanswered for -watchdog seconds, requests wait for a DWA and the connection
+	// is closed if the next DWR is not answered either
+	PEER_SUSPECT = "suspect"
+)
+
+var deviceWatchdogAnswerIdx = diam.CommandIndex{AppID: 0, Code: diam.DeviceWatchdog, Request: false}
+
+var errPeerDown = errors.New("peer is down")
+
+// an hss or eir of the scenario, kept connected for as long as the scenario runs:
+// a peer that can't be connected to or goes away (an hss restarting mid-soak) is connected
+// to again after a backoff, from -reconnect_min doubling up to -reconnect_max
+type Peer struct {
+	Name string
+	// the connection to the peer whichever one it is at the time, see peerConn
+	Conn diam.Conn
+	// the mme is the same whichever connection it is on, attachments are tracked by it
+	Cfg *sm.Settings
+	// where it is connected to, for tests that need a connection of their own
+	Addr  string
+	AppID uint32
+
+	setHandlers func(*sm.StateMachine, *sm.Settings)
+	// closed to stop reconnecting
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	lock  sync.Mutex
+	state string
+	// the last connection, nil until the first one opens
+	conn diam.Conn
+	// closed and replaced on every change of state, to wait for one
+	changed chan struct{}
+}
+
+func newPeer(name string, addr string, host string, app uint32,
+	setHandlers func(*sm.StateMachine, *sm.Settings)) *Peer {
+	p := &Peer{
+		Name:        name,
+		Addr:        addr,
+		Cfg:         newSettings(host),
+		AppID:       app,
+		setHandlers: setHandlers,
+		stop:        make(chan struct{}),
+		state:       PEER_CLOSED,
+		changed:     make(chan struct{}),
+	}
+	p.Conn = peerConn{p}
+	return p
+}
+
+func (p *Peer) State() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.state
+}
+
+// move p to state with conn as its connection
+// return: false if p was stopped, it stays closed then
+func (p *Peer) setState(state string, conn diam.Conn) bool {
+	select {
+	case <-p.stop:
+		if state != PEER_CLOSED {
+			return false
+		}
+	default:
+	}
+	p.lock.Lock()
+	old := p.state
+	p.state = state
+	if conn != nil {
+		p.conn = conn
+	}
+	if old != state {
+		close(p.changed)
+		p.changed = make(chan struct{})
+	}
+	p.lock.Unlock()
+	if old != state {
+		log.Printf("%s: %s -> %s", p.Name, old, state)
+		metrics.add("mock_mme_peer_state_changes_total", labels("peer", p.Name, "state", state), 1)
+	}
+	return true
+}
+
+// wait up to timeout for p to be open
+// return: its connection, false if it did not open in time or was stopped
+func (p *Peer) waitOpen(timeout time.Duration) (diam.Conn, bool) {
+	deadline := time.After(timeout)
+	for {
+		p.lock.Lock()
+		state, conn, changed := p.state, p.conn, p.changed
+		p.lock.Unlock()
+		if state == PEER_OPEN {
+			return conn, true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, false
+		case <-p.stop:
+			return nil, false
+		}
+	}
+}
+
+// connect to p and wait for the CEA
+// return: the connection and the channel its DWAs come in on, nil if it failed
+func (p *Peer) dial() (diam.Conn, chan struct{}) {
+	if !p.setState(PEER_WAIT_CEA, nil) {
+		return nil, nil
+	}
+	dwa := make(chan struct{}, 1)
+	conn := connect(p.Addr, p.Cfg, p.AppID, func(mux *sm.StateMachine, cfg *sm.Settings) {
+		p.setHandlers(mux, cfg)
+		mux.HandleIdx(deviceWatchdogAnswerIdx, diam.HandlerFunc(func(c diam.Conn, m *diam.Message) {
+			select {
+			case dwa <- struct{}{}:
+			default:
+			}
+		}))
+	})
+	if conn == nil {
+		p.setState(PEER_CLOSED, nil)
+		return nil, nil
+	}
+	if !p.setState(PEER_OPEN, conn) {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, dwa
+}
+
+// keep p connected until it is stopped, starting with the connection of its first dial
+func (p *Peer) manage(conn diam.Conn, dwa chan struct{}) {
+	backoff := *reconnectMin
+	for {
+		if conn != nil {
+			p.watch(conn, dwa)
+			p.setState(PEER_CLOSED, nil)
+			backoff = *reconnectMin
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		conn, dwa = p.dial()
+		if conn == nil {
+			log.Printf("%s: connecting again in %s", p.Name, backoff)
+			if backoff *= 2; backoff > *reconnectMax {
+				backoff = *reconnectMax
+			}
+		}
+	}
+}
+
+// watch an open connection until it closes, sending a DWR every -watchdog seconds
+// an unanswered DWR makes the peer suspect, a second one closes the connection
+func (p *Peer) watch(conn diam.Conn, dwa chan struct{}) {
+	closed := conn.(diam.CloseNotifier).CloseNotify()
+	// go-diameter only starts noticing the close with the next message it reads, so
+	// make sure one comes
+	if sendDWR(conn, p.Cfg) != nil {
+		conn.Close()
+		return
+	}
+	var tick <-chan time.Time
+	if *watchdog != 0 {
+		ticker := time.NewTicker(time.Duration(*watchdog) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	waiting := *watchdog != 0
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-p.stop:
+			// whoever stopped it closes the connection
+			return
+		case <-dwa:
+			waiting = false
+			p.setState(PEER_OPEN, conn)
+		case <-tick:
+			switch {
+			case !waiting:
+				waiting = true
+				err = sendDWR(conn, p.Cfg)
+			case p.State() == PEER_OPEN:
+				p.setState(PEER_SUSPECT, conn)
+				err = sendDWR(conn, p.Cfg)
+			default:
+				log.Printf("%s: no DWA, closing the connection", p.Name)
+				conn.Close()
+			}
+		}
+		if err != nil {
+			// closed without go-diameter noticing
+			conn.Close()
+			return
+		}
+	}
+}
+
+// stop reconnecting to p
+// return: its connection, false if it is not connected
+func (p *Peer) shutdown() (diam.Conn, bool) {
+	p.lock.Lock()
+	conn, connected := p.conn, p.state == PEER_OPEN || p.state == PEER_SUSPECT
+	p.lock.Unlock()
+	p.stopOnce.Do(func() { close(p.stop) })
+	return conn, connected
+}
+
+// Create & send Device-Watchdog Request
+func sendDWR(c diam.Conn, cfg *sm.Settings) error {
+	m := diam.NewRequest(diam.DeviceWatchdog, 0, dict.Default)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	m.NewAVP(avp.OriginStateID, avp.Mbit, 0, cfg.OriginStateID)
+	_, err := m.WriteTo(c)
+	if err != nil {
+		log.Printf("failed to send DWR to %s: %s", c.RemoteAddr(), err)
+	}
+	return err
+}
+
+// with -failover, send a request for a peer that is not open to the next open peer of its
+// application instead of waiting for it to open
+func reroute(c diam.Conn, m *diam.Message) diam.Conn {
+	pc, ok := c.(peerConn)
+	if !*failover || !ok || pc.peer.State() == PEER_OPEN {
+		return c
+	}
+	if p := alternatePeer(c); p != nil && failOver(m, p) {
+		metrics.add("mock_mme_rerouted_total", labels("peer", pc.peer.Name, "to", p.Name), 1)
+		return p.Conn
+	}
+	return c
+}
+
+// a diam.Conn that writes to the current connection of its peer, waiting up to -peer_wait for it
+// to open if it is not, so tests and retransmissions carry on over reconnections
+type peerConn struct {
+	peer *Peer
+}
+
+func (c peerConn) current() diam.Conn {
+	c.peer.lock.Lock()
+	defer c.peer.lock.Unlock()
+	return c.peer.conn
+}
+
+func (c peerConn) Write(b []byte) (int, error) {
+	conn, ok := c.peer.waitOpen(*peerWait)
+	if !ok {
+		return 0, errPeerDown
+	}
+	return conn.Write(b)
+}
+
+func (c peerConn) WriteStream(b []byte, stream uint) (int, error) {
+	conn, ok := c.peer.waitOpen(*peerWait)
+	if !ok {
+		return 0, errPeerDown
+	}
+	return conn.WriteStream(b, stream)
+}
+
+func (c peerConn) Close() {
+	if conn := c.current(); conn != nil {
+		conn.Close()
+	}
+}
+
+func (c peerConn) LocalAddr() net.Addr {
+	if conn := c.current(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// the address of the last connection, the configured one before the first
+func (c peerConn) RemoteAddr() net.Addr {
+	if conn := c.current(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return peerAddr(c.peer.Addr)
+}
+
+func (c peerConn) TLS() *tls.ConnectionState {
+	if conn := c.current(); conn != nil {
+		return conn.TLS()
+	}
+	return nil
+}
+
+func (c peerConn) Dictionary() *dict.Parser {
+	if conn := c.current(); conn != nil {
+		return conn.Dictionary()
+	}
+	return dict.Default
+}
+
+// the context of the last connection, which keeps the peer metadata of its CEA
+func (c peerConn) Context() context.Context {
+	if conn := c.current(); conn != nil {
+		return conn.Context()
+	}
+	return context.Background()
+}
+
+func (c peerConn) SetContext(ctx context.Context) {
+	if conn := c.current(); conn != nil {
+		conn.SetContext(ctx)
+	}
+}
+
+func (c peerConn) Connection() net.Conn {
+	if conn := c.current(); conn != nil {
+		return conn.Connection()
+	}
+	return nil
+}
+
+type peerAddr string
+
+func (a peerAddr) Network() string {
+	return *networkType
+}
+
+func (a peerAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a request rate that changes over the test, for finding where an hss stops keeping up
+// - ramp: StartRate to EndRate linearly over Duration
+// - step: StartRate, StepRate more after every Hold, Steps steps in all
+// - spike: BaseRate for Duration, SpikeRate from SpikeAt for SpikeFor
+// - sine: BaseRate swinging Amplitude up and down every Period over Duration, a day-curve
+type LoadProfile struct {
+	Type      string   `json:"type"`
+	StartRate float64  `json:"start_rate"`
+	EndRate   float64  `json:"end_rate"`
+	StepRate  float64  `json:"step_rate"`
+	Steps     int      `json:"steps"`
+	Hold      Duration `json:"hold"`
+	BaseRate  float64  `json:"base_rate"`
+	SpikeRate float64  `json:"spike_rate"`
+	SpikeAt   Duration `json:"spike_at"`
+	SpikeFor  Duration `json:"spike_for"`
+	Amplitude float64  `json:"amplitude"`
+	Period    Duration `json:"period"`
+	Duration  Duration `json:"duration"`
+	// length of the windows the results are reported in, the Hold of
+	// a step profile and a tenth of the test otherwise by default
+	Window Duration `json:"window"`
+	// a window is past the knee if fewer of its requests succeed than this,
+	// 0.99 by default
+	KneeSuccessRate float64 `json:"knee_success_rate"`
+	// or if its mean latency is more than this many times the one of the first window,
+	// 3 by default
+	KneeLatencyFactor float64 `json:"knee_latency_factor"`
+}
+
+// a time.Duration that reads "30s" from JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// parse the -profile flag, the type followed by the fields of LoadProfile
+// by their JSON names, e.g. step:start_rate=100,step_rate=100,steps=10,hold=30s
+func parseLoadProfile(spec string) (*LoadProfile, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	fields := map[string]interface{}{"type": parts[0]}
+	if len(parts) == 2 {
+		for _, field := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("invalid profile field " + field)
+			}
+			if n, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				fields[kv[0]] = n
+			} else {
+				fields[kv[0]] = kv[1]
+			}
+		}
+	}
+	// go through JSON so both forms of a profile read the same way
+	data, _ := json.Marshal(fields)
+	var p LoadProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, p.validate()
+}
+
+func (p *LoadProfile) validate() error {
+	switch p.Type {
+	case "ramp":
+		if p.Duration <= 0 || p.StartRate < 0 || p.EndRate < 0 || p.StartRate+p.EndRate == 0 {
+			return errors.New("ramp profile needs a duration and start_rate/end_rate")
+		}
+	case "step":
+		if p.Hold <= 0 || p.Steps <= 0 || p.StartRate < 0 || p.StartRate+p.StepRate <= 0 {
+			return errors.New("step profile needs start_rate, step_rate, steps and hold")
+		}
+	case "spike":
+		if p.Duration <= 0 || p.SpikeFor <= 0 || p.BaseRate < 0 || p.SpikeRate <= 0 {
+			return errors.New("spike profile needs a duration, base_rate, spike_rate, spike_at and spike_for")
+		}
+	case "sine":
+		if p.Duration <= 0 || p.Period <= 0 || p.BaseRate <= 0 {
+			return errors.New("sine profile needs a duration, base_rate, amplitude and period")
+		}
+	default:
+		return errors.New("unknown profile type " + p.Type + ", must be ramp, step, spike or sine")
+	}
+	return nil
+}
+
+// how long the profile runs
+func (p *LoadProfile) length() time.Duration {
+	if p.Type == "step" {
+		return time.Duration(p.Hold) * time.Duration(p.Steps)
+	}
+	return time.Duration(p.Duration)
+}
+
+// requests per second at t
+func (p *LoadProfile) rate(t time.Duration) float64 {
+	switch p.Type {
+	case "ramp":
+		return p.StartRate + (p.EndRate-p.StartRate)*t.Seconds()/p.length().Seconds()
+	case "step":
+		return p.StartRate + p.StepRate*float64(t/time.Duration(p.Hold))
+	case "spike":
+		if t >= time.Duration(p.SpikeAt) && t < time.Duration(p.SpikeAt+p.SpikeFor) {
+			return p.SpikeRate
+		}
+		return p.BaseRate
+	case "sine":
+		return math.Max(0, p.BaseRate+p.Amplitude*math.Sin(2*math.Pi*t.Seconds()/time.Duration(p.Period).Seconds()))
+	}
+	return 0
+}
+
+// number of requests the rate asks for from the start up to t, the integral of rate
+func (p *LoadProfile) requests(t time.Duration) float64 {
+	s := t.Seconds()
+	switch p.Type {
+	case "ramp":
+		return p.StartRate*s + (p.EndRate-p.StartRate)*s*s/(2*p.length().Seconds())
+	case "step":
+		hold := time.Duration(p.Hold).Seconds()
+		n := math.Floor(s / hold)
+		return hold*(n*p.StartRate+p.StepRate*n*(n-1)/2) + (s-n*hold)*p.rate(t)
+	case "spike":
+		start, end := time.Duration(p.SpikeAt).Seconds(), time.Duration(p.SpikeAt+p.SpikeFor).Seconds()
+		spiked := math.Max(0, math.Min(s, end)-start)
+		return p.BaseRate*s + (p.SpikeRate-p.BaseRate)*spiked
+	case "sine":
+		// the integral of max(0, B + A sin u) over u, then scaled to the period:
+		// the rate is clamped at 0 where the swing goes below it, over (lo, hi) of every turn
+		b, a := p.BaseRate, p.Amplitude
+		omega := 2 * math.Pi / time.Duration(p.Period).Seconds()
+		integral := func(from float64, to float64) float64 {
+			return b*(to-from) + a*(math.Cos(from)-math.Cos(to))
+		}
+		lo, hi := 0.0, 0.0
+		if math.Abs(a) > b {
+			alpha := math.Asin(b / math.Abs(a))
+			if a > 0 {
+				lo, hi = math.Pi+alpha, 2*math.Pi-alpha
+			} else {
+				lo, hi = alpha, math.Pi-alpha
+			}
+		}
+		u := omega * s
+		turns := math.Floor(u / (2 * math.Pi))
+		rest := u - 2*math.Pi*turns
+		perTurn := integral(0, 2*math.Pi) - integral(lo, hi)
+		return (turns*perTurn + integral(0, rest) - integral(lo, math.Max(lo, math.Min(rest, hi)))) / omega
+	}
+	return 0
+}
+
+// when each testFunc starts, worked out as the test goes from the rate at the time:
+// the next one is due once the rate integrated since the last one reaches 1, in steps
+// of at most 10ms so a rate that changes between two slow requests comes out right
+// the count comes from integrating the rate, a rate of 0 at the start sends nothing then
+func (p *LoadProfile) schedule() Schedule {
+	first := 0.0
+	if p.rate(0) > 0 {
+		// the first one goes out right away
+		first = 1
+	}
+	count := int(first + p.requests(p.length()))
+	offsets := func() func() (time.Duration, bool) {
+		const maxStep = 10 * time.Millisecond
+		var t time.Duration
+		due := first
+		given := 0
+		return func() (time.Duration, bool) {
+			if given == count {
+				return 0, false
+			}
+			for due < 1 && t < p.length() {
+				rate, step := p.rate(t), maxStep
+				if rate > 0 {
+					if left := time.Duration((1 - due) / rate * float64(time.Second)); left < step {
+						// at least 1ns so it gets there
+						step = left + 1
+					}
+				}
+				due += rate * step.Seconds()
+				t += step
+			}
+			if t >= p.length() {
+				// rounding left the walk short of the count, the rest goes at the end
+				t = p.length() - 1
+			}
+			due--
+			given++
+			return t, true
+		}
+	}
+	return Schedule{count, offsets}
+}
+
+func (p *LoadProfile) window() time.Duration {
+	switch {
+	case p.Window > 0:
+		return time.Duration(p.Window)
+	case p.Type == "step":
+		return time.Duration(p.Hold)
+	}
+	return p.length() / 10
+}
+
+// the results of one window of a profile test
+type StepResult struct {
+	Start time.Duration
+	End   time.Duration
+	// requests per second the schedule asked for
+	TargetRate float64
+	Total      int
+	Successes  int
+	Failures   int
+	Latencies  []time.Duration
+}
+
+func (step StepResult) successRate() float64 {
+	if step.Total == 0 {
+		return 1
+	}
+	return float64(step.Successes) / float64(step.Total)
+}
+
+func (step StepResult) meanLatency() time.Duration {
+	var sum time.Duration
+	for _, latency := range step.Latencies {
+		sum += latency
+	}
+	if len(step.Latencies) == 0 {
+		return 0
+	}
+	return sum / time.Duration(len(step.Latencies))
+}
+
+// split the results of a profile test into its windows
+func (p *LoadProfile) steps(schedule Schedule, numRequestsPerTest int, result TestResult) []StepResult {
+	window := p.window()
+	var steps []StepResult
+	for start := time.Duration(0); start < p.length(); start += window {
+		steps = append(steps, StepResult{Start: start, End: start + window})
+	}
+	stepOf := func(offset time.Duration) *StepResult {
+		i := int(offset / window)
+		if i >= len(steps) {
+			i = len(steps) - 1
+		}
+		return &steps[i]
+	}
+	next := schedule.Offsets()
+	for offset, ok := next(); ok; offset, ok = next() {
+		stepOf(offset).Total += numRequestsPerTest
+	}
+	for _, answer := range result.Answers {
+		step := stepOf(answer.Offset)
+		if answer.Success {
+			step.Successes++
+		} else {
+			step.Failures++
+		}
+		step.Latencies = append(step.Latencies, answer.Latency)
+	}
+	for i := range steps {
+		steps[i].TargetRate = float64(steps[i].Total/numRequestsPerTest) / window.Seconds()
+	}
+	return steps
+}
+
+// the first window the hss did not keep up in, -1 if it kept up all along
+func (p *LoadProfile) knee(steps []StepResult) int {
+	successRate, latencyFactor := p.KneeSuccessRate, p.KneeLatencyFactor
+	if successRate == 0 {
+		successRate = 0.99
+	}
+	if latencyFactor == 0 {
+		latencyFactor = 3
+	}
+	var baseline time.Duration
+	for i, step := range steps {
+		if step.Total == 0 {
+			continue
+		}
+		if baseline == 0 {
+			baseline = step.meanLatency()
+		}
+		if step.successRate() < successRate ||
+			(baseline > 0 && float64(step.meanLatency()) > latencyFactor*float64(baseline)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// print the success rate and latency of every window of a profile test,
+// and the highest rate the hss kept up with
+func printProfileResults(p *LoadProfile, steps []StepResult) {
+	for i, step := range steps {
+		max := time.Duration(0)
+		for _, latency := range step.Latencies {
+			if latency > max {
+				max = latency
+			}
+		}
+		log.Printf("   Step %d [%v-%v] at %.1f/s: %d/%d succeeded (%.2f%%), %d failed, "+
+			"mean latency %v, max latency %v\n",
+			i+1, step.Start, step.End, step.TargetRate, step.Successes, step.Total,
+			100*step.successRate(), step.Failures, step.meanLatency(), max)
+	}
+	knee := p.knee(steps)
+	// the highest rate before the knee
+	kept := 0.0
+	for i := 0; i < len(steps) && (knee < 0 || i < knee); i++ {
+		kept = math.Max(kept, steps[i].TargetRate)
+	}
+	if knee < 0 {
+		log.Printf("   Knee: not reached, kept up with %.1f/s\n", kept)
+	} else {
+		log.Printf("   Knee: step %d at %.1f/s, kept up with %.1f/s\n", knee+1, steps[knee].TargetRate, kept)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testProfiles = []string{
+	"ramp:start_rate=0,end_rate=100,duration=10s",
+	"ramp:start_rate=100,end_rate=300,duration=1s",
+	"step:start_rate=100,step_rate=50,steps=4,hold=1s",
+	"spike:base_rate=10,spike_rate=100,duration=10s,spike_at=5s,spike_for=1s",
+	"sine:base_rate=50,amplitude=30,period=3s,duration=10s",
+	// rates below 0 are clamped to 0
+	"sine:base_rate=50,amplitude=120,period=3s,duration=10s",
+	"sine:base_rate=50,amplitude=-120,period=3s,duration=10s",
+}
+
+func TestParseLoadProfile(t *testing.T) {
+	p, err := parseLoadProfile("step:start_rate=100,step_rate=50,steps=4,hold=1s,window=500ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != "step" || p.StartRate != 100 || p.StepRate != 50 || p.Steps != 4 ||
+		p.Hold != Duration(time.Second) || p.length() != 4*time.Second || p.window() != 500*time.Millisecond {
+		t.Errorf("%+v", p)
+	}
+	for _, spec := range []string{
+		"flat:rate=10",
+		"step:steps=2",
+		"ramp:start_rate=10",
+		"ramp:start_rate=10,end_rate=20,duration=soon",
+		"spike:base_rate=10,spike_rate=100,duration=10s",
+		"sine:amplitude=10,period=1s,duration=10s",
+		"ramp:start_rate",
+	} {
+		if _, err := parseLoadProfile(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestLoadProfileRate(t *testing.T) {
+	tests := []struct {
+		spec string
+		at   time.Duration
+		want float64
+	}{
+		{"ramp:start_rate=100,end_rate=300,duration=10s", 0, 100},
+		{"ramp:start_rate=100,end_rate=300,duration=10s", 5 * time.Second, 200},
+		{"step:start_rate=100,step_rate=50,steps=4,hold=1s", 999 * time.Millisecond, 100},
+		{"step:start_rate=100,step_rate=50,steps=4,hold=1s", 3 * time.Second, 250},
+		{"spike:base_rate=10,spike_rate=100,duration=10s,spike_at=5s,spike_for=1s", 5 * time.Second, 100},
+		{"spike:base_rate=10,spike_rate=100,duration=10s,spike_at=5s,spike_for=1s", 6 * time.Second, 10},
+		{"sine:base_rate=50,amplitude=30,period=4s,duration=10s", time.Second, 80},
+		{"sine:base_rate=50,amplitude=120,period=4s,duration=10s", 3 * time.Second, 0},
+	}
+	for _, test := range tests {
+		p, err := parseLoadProfile(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.rate(test.at); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s at %v: expected %v got %v", test.spec, test.at, test.want, got)
+		}
+	}
+}
+
+// requests is the integral of rate
+func TestLoadProfileRequests(t *testing.T) {
+	for _, spec := range testProfiles {
+		p, err := parseLoadProfile(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, at := range []time.Duration{300 * time.Millisecond, 1300 * time.Millisecond, 7 * time.Second, p.length()} {
+			if at > p.length() {
+				continue
+			}
+			sum := 0.0
+			for x := time.Duration(0); x < at; x += 10 * time.Microsecond {
+				sum += p.rate(x) * 1e-5
+			}
+			if got := p.requests(at); math.Abs(got-sum) > 0.05 {
+				t.Errorf("%s up to %v: expected %v requests got %v", spec, at, sum, got)
+			}
+		}
+	}
+}
+
+func TestLoadProfileSchedule(t *testing.T) {
+	for _, spec := range testProfiles {
+		p, err := parseLoadProfile(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := p.schedule()
+		if want := p.requests(p.length()); math.Abs(float64(s.Count)-want) > 1 {
+			t.Errorf("%s: %d requests for a rate that asks for %v", spec, s.Count, want)
+		}
+		next := s.Offsets()
+		n, last := 0, time.Duration(-1)
+		for offset, ok := next(); ok; offset, ok = next() {
+			if offset < last || offset >= p.length() {
+				t.Fatalf("%s: offset %v after %v", spec, offset, last)
+			}
+			if n == 0 && p.rate(0) == 0 && offset == 0 {
+				t.Fatalf("%s: sent at 0 with a rate of 0", spec)
+			}
+			// the requests of each second are about its rate
+			if second := offset.Truncate(time.Second); n > 0 && second != last.Truncate(time.Second) {
+				if got, want := float64(n), p.requests(second); math.Abs(got-want) > 2 {
+					t.Errorf("%s: %v requests by %v, expected %v", spec, got, second, want)
+				}
+			}
+			last = offset
+			n++
+		}
+		if n != s.Count {
+			t.Errorf("%s: %d offsets for a count of %d", spec, n, s.Count)
+		}
+	}
+}
+
+// a day-curve has tens of millions of requests, counting them must not walk the schedule
+func TestLoadProfileScheduleCount(t *testing.T) {
+	day, _ := parseLoadProfile("sine:base_rate=1000,amplitude=500,period=6h,duration=24h")
+	start := time.Now()
+	if c := day.schedule().Count; c < 86390000 || c > 86410000 {
+		t.Errorf("%d requests in a day at 1000/s", c)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("counting took %v", time.Since(start))
+	}
+}
+
+func TestLoadProfileKnee(t *testing.T) {
+	p, _ := parseLoadProfile("step:start_rate=100,step_rate=100,steps=4,hold=1s")
+	s := p.schedule()
+	// answers slow down from 3s on
+	var result TestResult
+	next := s.Offsets()
+	for offset, ok := next(); ok; offset, ok = next() {
+		latency := 5 * time.Millisecond
+		if offset >= 3*time.Second {
+			latency = 50 * time.Millisecond
+		}
+		result.Answers = append(result.Answers, Answer{Offset: offset, Latency: latency, Success: true})
+	}
+	steps := p.steps(s, 1, result)
+	if len(steps) != 4 || p.knee(steps) != 3 {
+		t.Fatalf("%d windows, knee %d", len(steps), p.knee(steps))
+	}
+	for i, step := range steps {
+		if want := float64(100 * (i + 1)); math.Abs(step.TargetRate-want) > 1 || step.Successes != step.Total {
+			t.Errorf("window %d: %+v", i, step)
+		}
+	}
+
+	// or fail from 2s on
+	for i := range result.Answers {
+		result.Answers[i].Latency = 5 * time.Millisecond
+		result.Answers[i].Success = result.Answers[i].Offset < 2*time.Second
+	}
+	if knee := p.knee(p.steps(s, 1, result)); knee != 2 {
+		t.Errorf("knee %d", knee)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"github.com/fiorix/go-diameter/diam/sm"
+	"github.com/fiorix/go-diameter/diam/sm/smpeer"
+)
+
+// Create & send Purge-UE Request
+// sent back the sid through the sent channel
+func sendPUR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, sent chan int, sentErr chan int) {
+	meta, ok := smpeer.FromContext(c.Context())
+	if !ok {
+		sentErr <- randomVal
+		return
+	}
+	trackAttachment(randomVal, *imsi, c, cfg)
+	sid := sessionIDFor(randomVal, string(cfg.OriginHost))
+	m := diam.NewRequest(diam.PurgeUE, diam.TGPP_S6A_APP_ID, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sid))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, meta.OriginRealm)
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, meta.OriginHost)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(*imsi))
+	m.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(0))
+	m.NewAVP(avp.PURFlags, avp.Vbit, uint32(*vendorID), datatype.Unsigned32(PUR_FLAGS))
+	// log.Printf("\nSending PUR to %s\n%s\n", c.RemoteAddr(), m)
+	err := sendRequest(c, m, randomVal, "PUR")
+	if err != nil {
+		sentErr <- randomVal
+	} else {
+		sent <- randomVal
+	}
+}
+
+// Handle PUA
+// send back the result through the ReceivedResult channel
+func handlePurgeUEAnswer(received chan ReceivedResult) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Purge-UE Answer from %s\n%s\n", c.RemoteAddr(), m)
+		countAnswer(c, m, "PUR")
+		sid, ok := matchAnswer(m)
+		if !ok {
+			return
+		}
+		var pua PUA
+		err := m.Unmarshal(&pua)
+		if err != nil {
+			log.Printf("PUA Unmarshal failed: %s", err)
+			updateAttachment(sid, false, false)
+			sendResult(received, ReceivedResult{sid, -2, c.RemoteAddr(), "PUR", answerResult(m)})
+		} else {
+			valid := validatePUAResponse(pua)
+			updateAttachment(sid, valid == 1, false)
+			if valid == 1 {
+				sendResult(received, ReceivedResult{sid, 0, c.RemoteAddr(), "PUR", answerResult(m)})
+			} else {
+				sendResult(received, ReceivedResult{sid, -1, c.RemoteAddr(), "PUR", answerResult(m)})
+			}
+			// log.Printf("Unmarshaled PU Answer:\n%#+v\n", pua)
+		}
+	}
+}
+
+// the HSS answers DIAMETER_ERROR_USER_UNKNOWN if it does not know the subscriber,
+// so a success means the HSS found the registration it has to clear
+func validatePUAResponse(pua PUA) int {
+	if pua.ResultCode != 0x7d1 {
+		return 0
+	}
+	return 1
+}
+
+// UE purged in MME
+const PUR_FLAGS = 1 << 0
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+var (
+	reattachLock sync.Mutex
+	// sids of the ULRs sent because of an RSR, their answers are not part of any test
+	reattachSids = make(map[int]bool)
+)
+
+// Handle RSR
+// acknowledges the reset and, with -rsr_reattach, re-ULRs every imsi attached
+// to this mme that is covered by the User-Id prefixes
+// parameters: cfg of the mme the request was sent to
+func handleResetRequest(cfg *sm.Settings) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Reset Request from %s\n%s\n", c.RemoteAddr(), m)
+		var rsr RSR
+		err := m.Unmarshal(&rsr)
+		if err != nil {
+			log.Printf("RSR Unmarshal failed: %s", err)
+			return
+		}
+		if len(rsr.UserIDs) == 0 {
+			log.Printf("RSR from %s (%s) for all subscribers", rsr.OriginHost, c.RemoteAddr())
+		} else {
+			log.Printf("RSR from %s (%s) for User-Id prefixes %v", rsr.OriginHost, c.RemoteAddr(), rsr.UserIDs)
+		}
+
+		a := newS6aAnswer(m, cfg, rsr.SessionID, 2001, 0)
+		// log.Printf("\nSending RSA to %s\n%s\n", c.RemoteAddr(), a)
+		_, err = a.WriteTo(c)
+		if err != nil {
+			log.Printf("failed to send RSA to %s: %s", c.RemoteAddr(), err)
+		}
+
+		if *rsrReattach {
+			// not on the connection's read loop, the ULAs have to be read by it
+			go reattach(attachedWithPrefix(cfg, rsr.UserIDs))
+		}
+	}
+}
+
+// send a ULR for every attachment to restore the hss's registrations
+func reattach(affected []Attachment) {
+	log.Printf("re-attaching %d imsis after reset", len(affected))
+	for i := 0; i < len(affected); i++ {
+		sid := nextSID()
+		reattachLock.Lock()
+		reattachSids[sid] = true
+		reattachLock.Unlock()
+
+		imsi := affected[i].IMSI
+		sentErr := make(chan int, 1)
+		sendULR(affected[i].Conn, affected[i].Cfg, &imsi, sid, make(chan int, 1), sentErr)
+		if len(sentErr) != 0 {
+			// not sent, there is no answer to wait for
+			isReattach(sid)
+		}
+		closeSessions([]int{sid})
+	}
+}
+
+// return: whether sid was a re-attach ULR, which is then forgotten
+func isReattach(sid int) bool {
+	reattachLock.Lock()
+	defer reattachLock.Unlock()
+	ok := reattachSids[sid]
+	delete(reattachSids, sid)
+	return ok
+}
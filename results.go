@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what a test did, for the -results_* files so CI can gate on a run without scraping logs
+type TestReport struct {
+	Name      string `json:"name"`
+	Procedure string `json:"procedure"`
+	Passed    bool   `json:"passed"`
+	// why the test did not run, empty if it did
+	Skipped string `json:"skipped,omitempty"`
+	// failed expectations and other reasons the test did not pass
+	Problems  []string      `json:"problems,omitempty"`
+	Successes int           `json:"successes"`
+	Failures  int           `json:"failures"`
+	Missing   int           `json:"missing"`
+	Total     int           `json:"total"`
+	Sent      int           `json:"sent"`
+	TimedOut  int           `json:"timed_out"`
+	Duration  time.Duration `json:"-"`
+	Latency   LatencyStats  `json:"latency"`
+	// only for searches
+	Search *SearchReport `json:"search,omitempty"`
+	// every answer the test got
+	Answers []Answer `json:"-"`
+	// every request it sent
+	Requests []Request `json:"-"`
+}
+
+// the outcome of a throughput search
+type SearchReport struct {
+	MaxSustainableRate float64 `json:"max_sustainable_rate"`
+	Trials             []Trial `json:"trials"`
+}
+
+// the tests of the run so far, in the order they ran
+var testReports []TestReport
+
+func newTestReport(test TestConfig, result TestResult, problems []string) TestReport {
+	return TestReport{
+		Name:      test.Name,
+		Procedure: test.Procedure,
+		Passed:    len(problems) == 0,
+		Problems:  problems,
+		Successes: result.Successes,
+		Failures:  result.Failures,
+		Missing:   result.Total - (result.Successes + result.Failures),
+		Total:     result.Total,
+		Sent:      result.Sent,
+		TimedOut:  result.TimedOut,
+		Duration:  result.Duration,
+		Latency:   newLatencyStats(result.Latencies()),
+		Answers:   result.Answers,
+		Requests:  result.Requests,
+	}
+}
+
+func reportTest(report TestReport) {
+	testReports = append(testReports, report)
+}
+
+// write the reports to every -results_* file that is set
+func writeResults() error {
+	if *resultsJSON != "" {
+		if err := writeResultsJSON(*resultsJSON); err != nil {
+			return err
+		}
+	}
+	if *resultsCSV != "" {
+		if err := writeResultsCSV(*resultsCSV); err != nil {
+			return err
+		}
+	}
+	if *requestsCSV != "" {
+		if err := writeRequestsCSV(*requestsCSV); err != nil {
+			return err
+		}
+	}
+	if *resultsJUnit != "" {
+		if err := writeResultsJUnit(*resultsJUnit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// durations are in seconds and latencies in milliseconds
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (stats LatencyStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"count": stats.Count, "min_ms": ms(stats.Min), "mean_ms": ms(stats.Mean), "p50_ms": ms(stats.P50),
+		"p90_ms": ms(stats.P90), "p99_ms": ms(stats.P99), "p999_ms": ms(stats.P999), "max_ms": ms(stats.Max),
+	})
+}
+
+func (t Trial) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"rate": t.Rate, "failure_rate": t.FailureRate, "p99_ms": ms(t.P99), "passed": t.Passed,
+	})
+}
+
+func (a Answer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"offset_ms": ms(a.Offset), "latency_ms": ms(a.Latency), "success": a.Success,
+		"peer": a.Peer, "procedure": a.Procedure,
+	})
+}
+
+// latency_ms only for answered requests
+func (r Request) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{
+		"imsi": r.IMSI, "sid": r.SID, "peer": r.Peer, "procedure": r.Procedure, "outcome": r.Outcome,
+		"result_code": r.ResultCode,
+	}
+	if r.Outcome == "answered" {
+		fields["latency_ms"] = ms(r.Latency)
+	}
+	return json.Marshal(fields)
+}
+
+// the whole run, with every request and answer of every test
+func writeResultsJSON(path string) error {
+	type test struct {
+		TestReport
+		Duration float64   `json:"duration_s"`
+		Requests []Request `json:"requests"`
+		Answers  []Answer  `json:"answers"`
+	}
+	run := struct {
+		Passed bool   `json:"passed"`
+		Tests  []test `json:"tests"`
+	}{Passed: true, Tests: []test{}}
+	for _, report := range testReports {
+		run.Passed = run.Passed && report.Passed
+		requests, answers := report.Requests, report.Answers
+		if requests == nil {
+			requests = []Request{}
+		}
+		if answers == nil {
+			answers = []Answer{}
+		}
+		run.Tests = append(run.Tests, test{report, report.Duration.Seconds(), requests, answers})
+	}
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func writeCSV(path string, records [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(records)
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// one line per test
+func writeResultsCSV(path string) error {
+	records := [][]string{{"test", "procedure", "passed", "skipped", "successes", "failures", "missing", "total",
+		"sent", "timed_out", "duration_s", "min_ms", "mean_ms", "p50_ms", "p90_ms", "p99_ms", "p999_ms", "max_ms", "problems"}}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, r := range testReports {
+		l := r.Latency
+		records = append(records, []string{r.Name, r.Procedure, strconv.FormatBool(r.Passed), r.Skipped,
+			strconv.Itoa(r.Successes), strconv.Itoa(r.Failures), strconv.Itoa(r.Missing), strconv.Itoa(r.Total),
+			strconv.Itoa(r.Sent), strconv.Itoa(r.TimedOut), f(r.Duration.Seconds()), f(ms(l.Min)), f(ms(l.Mean)), f(ms(l.P50)),
+			f(ms(l.P90)), f(ms(l.P99)), f(ms(l.P999)), f(ms(l.Max)), strings.Join(r.Problems, "; ")})
+	}
+	return writeCSV(path, records)
+}
+
+// one line per sent request, answered or not
+func writeRequestsCSV(path string) error {
+	records := [][]string{{"test", "imsi", "sid", "peer", "procedure", "outcome", "result_code", "latency_ms"}}
+	f := func(d time.Duration) string { return strconv.FormatFloat(ms(d), 'f', -1, 64) }
+	for _, r := range testReports {
+		for _, req := range r.Requests {
+			latency := ""
+			if req.Outcome == "answered" {
+				latency = f(req.Latency)
+			}
+			records = append(records, []string{r.Name, req.IMSI, strconv.Itoa(req.SID), req.Peer, req.Procedure,
+				req.Outcome, req.ResultCode, latency})
+		}
+	}
+	return writeCSV(path, records)
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// a testsuite with a testcase per test, failed if its expectations were not met
+func writeResultsJUnit(path string) error {
+	suite := junitTestSuite{Name: "mock_mme", Tests: len(testReports)}
+	for _, r := range testReports {
+		c := junitTestCase{Name: r.Name, ClassName: "mock_mme." + r.Procedure, Time: r.Duration.Seconds()}
+		switch {
+		case r.Skipped != "":
+			suite.Skipped++
+			c.Skipped = &junitMessage{Message: r.Skipped}
+		case !r.Passed:
+			suite.Failures++
+			c.Failure = &junitMessage{Message: strings.Join(r.Problems, "; "), Text: strings.Join(r.Problems, "\n")}
+		}
+		switch {
+		case r.Search != nil:
+			c.SystemOut = "max sustainable rate=" + strconv.FormatFloat(r.Search.MaxSustainableRate, 'f', 1, 64) +
+				"/s trials=" + strconv.Itoa(len(r.Search.Trials))
+		case r.Skipped == "":
+			c.SystemOut = "successes=" + strconv.Itoa(r.Successes) + " failures=" + strconv.Itoa(r.Failures) +
+				" missing=" + strconv.Itoa(r.Missing) + " latency: " + r.Latency.String()
+		}
+		suite.Time += r.Duration.Seconds()
+		suite.Cases = append(suite.Cases, c)
+	}
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
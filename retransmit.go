@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/sm/smpeer"
+)
+
+// a request that timed out, to send again with the T flag and the same End-to-End ID
+// (RFC 6733 5.5.4) to the same peer or, with -failover, to the next one of its application
+type retransmission struct {
+	conn      diam.Conn
+	msg       *diam.Message
+	procedure string
+}
+
+var (
+	failoverLock sync.Mutex
+	// application to its peers, in scenario order
+	failoverPeers = make(map[string][]*Peer)
+
+	retransmitLock sync.Mutex
+	// number of retransmissions, duplicate answers... since the last printRetransmissions
+	retransmitCounts = make(map[string]int)
+)
+
+// let requests to the other peers of app fail over to p
+func addFailoverPeer(app string, p *Peer) {
+	failoverLock.Lock()
+	failoverPeers[app] = append(failoverPeers[app], p)
+	failoverLock.Unlock()
+}
+
+// the first open peer after the one of c among the peers of its application, nil if it has none
+func alternatePeer(c diam.Conn) *Peer {
+	failoverLock.Lock()
+	defer failoverLock.Unlock()
+	for _, peers := range failoverPeers {
+		for i := 0; i < len(peers); i++ {
+			if peers[i].Conn != c {
+				continue
+			}
+			for j := 1; j < len(peers); j++ {
+				if p := peers[(i+j)%len(peers)]; p.State() == PEER_OPEN {
+					return p
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// give m a new Hop-by-Hop ID and the hosts and realm of the alternate peer p
+// if p's mme is another host, m goes out in a new session of that host, as Session-Ids
+// start with the host sending them
+// return: false if p has not had a CEA yet
+func failOver(m *diam.Message, p *Peer) bool {
+	meta, ok := smpeer.FromContext(p.Conn.Context())
+	if !ok {
+		return false
+	}
+	m.Header.HopByHopID = rand.Uint32()
+	if a, err := m.FindAVP(avp.OriginHost, 0); err == nil && a.Data != p.Cfg.OriginHost {
+		replaceAVP(m, avp.SessionID, datatype.UTF8String(newSessionID(string(p.Cfg.OriginHost))))
+	}
+	replaceAVP(m, avp.OriginHost, p.Cfg.OriginHost)
+	replaceAVP(m, avp.DestinationHost, meta.OriginHost)
+	replaceAVP(m, avp.DestinationRealm, meta.OriginRealm)
+	return true
+}
+
+// a copy of m to change, the transaction table keeps reading the original
+func cloneMessage(m *diam.Message) (*diam.Message, error) {
+	b, err := m.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return diam.ReadMessage(bytes.NewReader(b), m.Dictionary())
+}
+
+// resend a timed out request, with a new Hop-by-Hop ID and the hosts and realm of the alternate peer
+// if it fails over
+func (r retransmission) send() {
+	m, err := cloneMessage(r.msg)
+	if err != nil {
+		log.Printf("retransmitting %d failed: %s", r.msg.Header.EndToEndID, err)
+		return
+	}
+	c := r.conn
+	m.Header.CommandFlags |= diam.RetransmittedFlag
+	if *failover {
+		if p := alternatePeer(c); p != nil && failOver(m, p) {
+			c = p.Conn
+			countRetransmission("failed_over")
+		}
+	}
+	transactions.resent(m, c)
+	countRetransmission("retransmitted")
+	_, err = m.WriteTo(c)
+	countSent(c, r.procedure, err)
+	if err != nil {
+		log.Printf("retransmitting %d to %s failed: %s", m.Header.EndToEndID, c.RemoteAddr(), err)
+	}
+}
+
+// set the data of the top-level AVP code of m, if it has one
+func replaceAVP(m *diam.Message, code uint32, data datatype.Type) {
+	a, err := m.FindAVP(code, 0)
+	if err != nil {
+		return
+	}
+	a.Data = data
+	// the AVP Length leaves out the padding
+	a.Length = 8 + a.Data.Len()
+	if a.Flags&avp.Vbit == avp.Vbit {
+		a.Length += 4
+	}
+	// the Message Length counts it, as m.Len() does
+	m.Header.MessageLength = uint32(m.Len())
+}
+
+func countRetransmission(kind string) {
+	retransmitLock.Lock()
+	retransmitCounts[kind]++
+	retransmitLock.Unlock()
+	metrics.add("mock_mme_retransmissions_total", labels("kind", kind), 1)
+}
+
+// print the retransmissions since the last call and how the hss answered them,
+// nothing if there were none
+// an hss that detects duplicates answers both copies of a request the same way
+func printRetransmissions() {
+	retransmitLock.Lock()
+	defer retransmitLock.Unlock()
+	if len(retransmitCounts) == 0 {
+		return
+	}
+	var kinds []string
+	for kind := range retransmitCounts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	log.Printf("   Retransmissions:\n")
+	for _, kind := range kinds {
+		log.Printf("      %s: %d\n", kind, retransmitCounts[kind])
+	}
+	retransmitCounts = make(map[string]int)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+// a test scenario, the tests run by main() in order
+// loaded from the JSON file given with -scenario, see scenarios/ for examples
+type Scenario struct {
+	Peers []PeerConfig `json:"peers"`
+	// CSV subscriber file, see loadSubscribers, instead of the one given with -subscribers
+	Subscribers string `json:"subscribers"`
+	// named imsi sources, see IMSISource for the syntax
+	IMSISets map[string]IMSISpec `json:"imsi_sets"`
+	Tests    []TestConfig        `json:"tests"`
+}
+
+// a diameter peer (hss or eir) the mme connects to
+type PeerConfig struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	// diameter identity of the mme towards this peer
+	Host string `json:"host"`
+	// s6a (default) or s13
+	App string `json:"app"`
+}
+
+// one runScheduledTest of a procedure
+type TestConfig struct {
+	Name      string   `json:"name"`
+	Procedure string   `json:"procedure"`
+	Peers     []string `json:"peers"`
+	// name of the imsi set, or of an imei set for s13 procedures and a set of
+	// Disconnect-Causes for dpr
+	IMSIs string `json:"imsis"`
+	// number of times the procedure is run, defaults to the size of the imsi set
+	// required for random imsi sets
+	Count int `json:"count"`
+	// run the procedure rate times per second for duration (e.g. "5m") instead of
+	// count times at once, open loop
+	Rate     float64 `json:"rate"`
+	Duration string  `json:"duration"`
+	// or at a rate that changes over the test, reported step by step
+	Profile *LoadProfile `json:"profile"`
+	// or search for the highest rate the hss sustains instead
+	Search *ThroughputSearch `json:"search"`
+
+	Expect *Expectation `json:"expect"`
+}
+
+// expected outcome of a test, unset counts are not checked
+type Expectation struct {
+	Successes *int `json:"successes"`
+	Failures  *int `json:"failures"`
+	Missing   *int `json:"missing"`
+}
+
+// a procedure tests can run
+type Procedure struct {
+	// number of peers it needs, in the order the testFunc takes them
+	Peers int
+	// number of requests in each testFunc
+	RequestsPerTest int
+	// whether it needs -ki/-opc
+	NeedsKeys bool
+	TestFunc  func(peers []*Peer) func([]int, *string, chan int, chan int)
+	// optional extra reporting once the test is done, gets the imsis the test used
+	After func(index int, test TestConfig, peers []*Peer, imsis []*string, start time.Time)
+}
+
+var procedures = map[string]Procedure{
+	"load": {
+		Peers: 1, RequestsPerTest: 1,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return loadTest(p[0].Conn, p[0].Cfg)
+		},
+	},
+	"auth": {
+		Peers: 1, RequestsPerTest: 1,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return authLoadTest(p[0].Conn, p[0].Cfg)
+		},
+	},
+	"resync": {
+		Peers: 1, RequestsPerTest: 2, NeedsKeys: true,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return resyncTest(p[0].Conn, p[0].Cfg, *resyncSQN)
+		},
+	},
+	"two_hss": {
+		Peers: 2, RequestsPerTest: 2,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return twoHSSTest(p[0].Conn, p[1].Conn, p[0].Cfg, p[1].Cfg)
+		},
+		// the re-registration under the 2nd mme has to cancel the 1st one
+		After: func(index int, test TestConfig, p []*Peer, imsis []*string, start time.Time) {
+			if p[0].Cfg.OriginHost != p[1].Cfg.OriginHost {
+				printCancellations(index, test.Name+" - cancellations of the old mme",
+					imsis, string(p[0].Cfg.OriginHost), start)
+			}
+		},
+	},
+	"two_hss_purge": {
+		Peers: 2, RequestsPerTest: 2,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return twoHSSPurgeTest(p[0].Conn, p[1].Conn, p[0].Cfg, p[1].Cfg)
+		},
+	},
+	"notify": {
+		Peers: 1, RequestsPerTest: 2,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return notifyTest(p[0].Conn, p[0].Cfg)
+		},
+	},
+	"dpr": {
+		Peers: 1, RequestsPerTest: 1,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return disconnectTest(p[0])
+		},
+	},
+	"eir": {
+		Peers: 1, RequestsPerTest: 1,
+		TestFunc: func(p []*Peer) func([]int, *string, chan int, chan int) {
+			return eirTest(p[0].Conn, p[0].Cfg)
+		},
+		After: func(index int, test TestConfig, p []*Peer, imsis []*string, start time.Time) {
+			printEquipmentStatuses()
+			resetEquipmentStatuses()
+		},
+	},
+}
+
+// read and check a scenario file
+func loadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc Scenario
+	if err = json.Unmarshal(data, &sc); err != nil {
+		return nil, err
+	}
+	if sc.Subscribers != "" && len(subscribers) == 0 {
+		if err = loadSubscribers(sc.Subscribers); err != nil {
+			return nil, err
+		}
+	}
+	return &sc, sc.validate()
+}
+
+// make sure every test refers to a known procedure, peers and imsi set
+func (sc *Scenario) validate() error {
+	peers := make(map[string]bool)
+	for _, p := range sc.Peers {
+		if p.App != "" && p.App != "s6a" && p.App != "s13" {
+			return errors.New("peer " + p.Name + ": unknown app " + p.App)
+		}
+		peers[p.Name] = true
+	}
+	for _, t := range sc.Tests {
+		proc, ok := procedures[t.Procedure]
+		if !ok {
+			return errors.New("test " + t.Name + ": unknown procedure " + t.Procedure)
+		}
+		if len(t.Peers) != proc.Peers {
+			return errors.New("test " + t.Name + ": procedure " + t.Procedure +
+				" needs " + strconv.Itoa(proc.Peers) + " peers")
+		}
+		for _, name := range t.Peers {
+			if !peers[name] {
+				return errors.New("test " + t.Name + ": unknown peer " + name)
+			}
+		}
+		src, err := sc.source(t.IMSIs, nil)
+		if err != nil {
+			return errors.New("test " + t.Name + ": " + err.Error())
+		}
+		// eir tests are given imeis, random ones are checked as they are sent
+		for i := 0; t.Procedure == "eir" && i < src.Len(); i++ {
+			if err = validateIMEI(*src.Next()); err != nil {
+				return errors.New("test " + t.Name + ": " + err.Error())
+			}
+		}
+		if t.Rate < 0 {
+			return errors.New("test " + t.Name + ": negative rate")
+		}
+		if t.Search != nil {
+			if t.Rate > 0 || t.Profile != nil || t.Expect != nil {
+				return errors.New("test " + t.Name + ": a search has no rate, profile or expectations")
+			}
+			if err = t.Search.validate(); err != nil {
+				return errors.New("test " + t.Name + ": " + err.Error())
+			}
+		} else if t.Profile != nil {
+			if t.Rate > 0 {
+				return errors.New("test " + t.Name + ": a test has either a rate or a profile")
+			}
+			if err = t.Profile.validate(); err != nil {
+				return errors.New("test " + t.Name + ": " + err.Error())
+			}
+		} else if t.Rate > 0 {
+			if _, err = t.duration(); err != nil {
+				return errors.New("test " + t.Name + ": " + err.Error())
+			}
+		} else if src.Len() == 0 && t.Count == 0 {
+			return errors.New("test " + t.Name + ": imsi set " + t.IMSIs + " is random, a count is required")
+		}
+	}
+	return nil
+}
+
+// the scenario main() runs without -scenario, built from the flags
+// parameters: the -profile load profile, nil if there is none
+func defaultScenario(profile *LoadProfile) *Scenario {
+	sc := &Scenario{
+		Peers: []PeerConfig{
+			{Name: "hss1", Addr: *addrs[0], Host: *hosts[0], App: "s6a"},
+			{Name: "hss2", Addr: *addrs[1], Host: *hosts[1], App: "s6a"},
+		},
+		IMSISets: map[string]IMSISpec{
+			"first": IMSISpec(*goodIMSIs),
+			"good":  IMSISpec(*goodIMSIs),
+			"bad":   IMSISpec(*badIMSIs),
+			"mix":   IMSISpec(*mixIMSIs),
+		},
+	}
+	// test the provisioned subscribers if there are any
+	if len(subscribers) != 0 {
+		sc.IMSISets["good"] = "subscribers"
+	}
+	// the load tests hammer a single imsi
+	if src, err := newIMSISource(string(sc.IMSISets["good"]), nil); err == nil {
+		sc.IMSISets["first"] = IMSISpec(*src.Next())
+	}
+	// run load tests with 1 single imsi
+	for i := 0; i < len(loadTestRequestNums); i++ {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "Load Testing 1 HSS Results with " + strconv.Itoa(loadTestRequestNums[i]) + " requests",
+			Procedure: "load", Peers: []string{"hss1"}, IMSIs: "first", Count: loadTestRequestNums[i],
+		})
+	}
+	// run auth load tests with 1 single imsi, they double the load so only when asked for
+	for i := 0; *authLoad && i < len(loadTestRequestNums); i++ {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "Auth Load Testing 1 HSS Results with " + strconv.Itoa(loadTestRequestNums[i]) + " requests",
+			Procedure: "auth", Peers: []string{"hss1"}, IMSIs: "first", Count: loadTestRequestNums[i],
+		})
+	}
+	// open loop ulr load at a constant rate
+	if *rate > 0 {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "Open Loop Load Testing 1 HSS at " + strconv.FormatFloat(*rate, 'f', -1, 64) + " requests/s",
+			Procedure: "load", Peers: []string{"hss1"}, IMSIs: "good",
+			Rate: *rate, Duration: rateDuration.String(),
+		})
+	}
+	// ulr load following a profile
+	if profile != nil {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "Profile Load Testing 1 HSS - " + *profileSpec,
+			Procedure: "load", Peers: []string{"hss1"}, IMSIs: "good", Profile: profile,
+		})
+	}
+	// how fast can the hss go
+	if *searchMaxRate > 0 {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "Max Throughput Search 1 HSS",
+			Procedure: "load", Peers: []string{"hss1"}, IMSIs: "good",
+			Search: &ThroughputSearch{MinRate: *searchMinRate, MaxRate: *searchMaxRate},
+		})
+	}
+	// resynchronise the SQN of 1 single imsi
+	if *resync {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "AUTS Resynchronisation Testing 1 HSS",
+			Procedure: "resync", Peers: []string{"hss1"}, IMSIs: "first",
+		})
+	}
+	sc.Tests = append(sc.Tests,
+		TestConfig{
+			Name:      "2 HSS Testing - success cases",
+			Procedure: "two_hss", Peers: []string{"hss1", "hss2"}, IMSIs: "good",
+		},
+		TestConfig{
+			Name:      "2 HSS Testing - failure cases",
+			Procedure: "two_hss", Peers: []string{"hss1", "hss2"}, IMSIs: "bad",
+		},
+		TestConfig{
+			Name:      "2 HSS Testing - mixture cases",
+			Procedure: "two_hss", Peers: []string{"hss1", "hss2"}, IMSIs: "mix", Count: 12,
+		},
+	)
+	// purges the good imsis
+	if *purgeTest {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "2 HSS Testing - purge cases",
+			Procedure: "two_hss_purge", Peers: []string{"hss1", "hss2"}, IMSIs: "good",
+		})
+	}
+	// updates the PDN GW of the good imsis
+	if *notifyPDNs {
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "Notify Testing 1 HSS - PDN GW updates",
+			Procedure: "notify", Peers: []string{"hss1"}, IMSIs: "good",
+		})
+	}
+	// how the hss takes being disconnected, on connections of their own
+	if *dprTest {
+		sc.IMSISets["disconnect_causes"] = IMSISpec(strconv.Itoa(REBOOTING) + "," + strconv.Itoa(BUSY) + "," +
+			strconv.Itoa(DO_NOT_WANT_TO_TALK_TO_YOU))
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "Disconnect-Peer Testing 1 HSS - every Disconnect-Cause",
+			Procedure: "dpr", Peers: []string{"hss1"}, IMSIs: "disconnect_causes",
+		})
+	}
+	// eir test - check every configured imei
+	if *eirAddr != "" {
+		sc.Peers = append(sc.Peers, PeerConfig{Name: "eir", Addr: *eirAddr, Host: *eirHost, App: "s13"})
+		sc.IMSISets["imeis"] = IMSISpec(strings.Join(derefAll(parseIMEIs(*imeis)), ","))
+		sc.Tests = append(sc.Tests, TestConfig{
+			Name:      "EIR Testing - equipment identity checks",
+			Procedure: "eir", Peers: []string{"eir"}, IMSIs: "imeis",
+		})
+	}
+	return sc
+}
+
+// connect to every peer of the scenario
+// parameters: functions setting the message handlers for s6a and s13 connections
+func connectPeers(configs []PeerConfig, s6aHandlers func(*sm.StateMachine, *sm.Settings),
+	s13Handlers func(*sm.StateMachine, *sm.Settings)) map[string]*Peer {
+	peers := make(map[string]*Peer)
+	for _, pc := range configs {
+		var p *Peer
+		if pc.App == "s13" {
+			p = newPeer(pc.Name, pc.Addr, pc.Host, TGPP_S13_APP_ID, s13Handlers)
+			addFailoverPeer("s13", p)
+		} else {
+			p = newPeer(pc.Name, pc.Addr, pc.Host, uint32(*appID), s6aHandlers)
+			addFailoverPeer("s6a", p)
+		}
+		peers[pc.Name] = p
+		// the first try is made right away, the peer keeps trying after that
+		conn, dwa := p.dial()
+		go p.manage(conn, dwa)
+	}
+	return peers
+}
+
+// run every test of the scenario in order
+// return: whether all tests met their expectations
+func runScenario(sc *Scenario, peers map[string]*Peer) bool {
+	passed := true
+	scenarioStart := time.Now()
+
+	for i, test := range sc.Tests {
+		if isShuttingDown() {
+			log.Printf("shutting down, skipping the remaining %d tests", len(sc.Tests)-i)
+			break
+		}
+		proc := procedures[test.Procedure]
+		if proc.NeedsKeys && authKeys == nil && len(subscribers) == 0 {
+			log.Printf("skipping %s, -ki and -opc or a subscriber file are required", test.Name)
+			reportTest(TestReport{Name: test.Name, Procedure: test.Procedure, Passed: true,
+				Skipped: "-ki and -opc or a subscriber file are required"})
+			continue
+		}
+
+		var testPeers []*Peer
+		var problems []string
+		for _, name := range test.Peers {
+			if _, ok := peers[name].waitOpen(*peerWait); !ok {
+				log.Printf("skipping %s, %s is not connected", test.Name, name)
+				problems = append(problems, name+" is not connected")
+			}
+			testPeers = append(testPeers, peers[name])
+		}
+		if len(problems) != 0 {
+			reportTest(TestReport{Name: test.Name, Procedure: test.Procedure, Problems: problems})
+			passed = false
+			continue
+		}
+
+		// checked by validate
+		src, _ := sc.source(test.IMSIs, nil)
+		imsis := newRecordingSource(src)
+		testStart := time.Now()
+		if test.Search != nil {
+			search := test.Search.withDefaults()
+			log.Printf("%d. %s:", i+1, test.Name)
+			trials, best := search.run(proc.TestFunc(testPeers), imsis, proc.RequestsPerTest)
+			printSearchResults(search, trials, best)
+			reportTest(TestReport{Name: test.Name, Procedure: test.Procedure, Passed: true,
+				Duration: time.Since(testStart), Search: &SearchReport{best, trials}})
+			continue
+		}
+		schedule := test.schedule(imsis)
+		result := runScheduledTest(proc.TestFunc(testPeers), imsis, schedule, proc.RequestsPerTest, false)
+		printResults(i+1, test.Name, result)
+		if test.Rate > 0 {
+			printRateResults(test.Rate, result)
+		}
+		if test.Profile != nil {
+			printProfileResults(test.Profile, test.Profile.steps(schedule, proc.RequestsPerTest, result))
+		}
+		printAnswerAnomalies()
+		printRetransmissions()
+		printAPNs()
+		printFieldDiffs()
+		if proc.After != nil {
+			proc.After(i+1, test, testPeers, imsis.used, testStart)
+		}
+		problems = checkExpectation(test.Expect, result.Successes, result.Failures, result.Total)
+		if len(problems) != 0 {
+			passed = false
+		}
+		reportTest(newTestReport(test, result, problems))
+	}
+
+	// whatever subscription data the hss pushed while the tests ran, and whether it is what
+	// the subscriber file has
+	printSubscriberDataUpdates(len(sc.Tests)+1, "Subscriber Data Updates", scenarioStart)
+	if checked, problems := checkSubscriberDataUpdates(scenarioStart); checked != 0 {
+		if len(problems) != 0 {
+			passed = false
+		}
+		reportTest(TestReport{Name: "Subscriber Data Updates", Procedure: "idr",
+			Passed: len(problems) == 0, Problems: problems, Total: checked})
+	}
+	return passed
+}
+
+// when the testFuncs of the test start, checked by validate
+func (test TestConfig) schedule(imsis IMSISource) Schedule {
+	if test.Profile != nil {
+		return test.Profile.schedule()
+	}
+	if test.Rate > 0 {
+		duration, _ := test.duration()
+		return rateSchedule(test.Rate, duration)
+	}
+	count := test.Count
+	if count == 0 {
+		count = imsis.Len()
+	}
+	return burstSchedule(count)
+}
+
+func (test TestConfig) duration() (time.Duration, error) {
+	if test.Duration == "" {
+		return 0, errors.New("a rate needs a duration")
+	}
+	duration, err := time.ParseDuration(test.Duration)
+	if err == nil && duration <= 0 {
+		err = errors.New("duration must be positive")
+	}
+	return duration, err
+}
+
+// log whether the counts of a test are the expected ones
+// return: one line per count that is not the expected one, empty if all are
+func checkExpectation(exp *Expectation, successes int, failures int, total int) []string {
+	var problems []string
+	if exp == nil {
+		return problems
+	}
+	check := func(name string, expected *int, actual int) {
+		if expected != nil && *expected != actual {
+			problems = append(problems, fmt.Sprintf("expected %d %s, got %d", *expected, name, actual))
+			log.Printf("   %s\n", problems[len(problems)-1])
+		}
+	}
+	check("successes", exp.Successes, successes)
+	check("failures", exp.Failures, failures)
+	check("missing", exp.Missing, total-(successes+failures))
+	if len(problems) == 0 {
+		log.Printf("   Expectations: PASS\n")
+	} else {
+		log.Printf("   Expectations: FAIL\n")
+	}
+	return problems
+}
+
+func derefAll(ps []*string) []string {
+	s := make([]string, len(ps))
+	for i := 0; i < len(ps); i++ {
+		s[i] = *ps[i]
+	}
+	return s
+}
+
+// a fresh source for the named imsi set, every test starts from the beginning of it
+// parameters: the name of the set, and the sets a mix is already being built for
+func (sc *Scenario) source(name string, building map[string]bool) (IMSISource, error) {
+	spec, ok := sc.IMSISets[name]
+	if !ok {
+		return nil, errors.New("unknown imsi set " + name)
+	}
+	if building == nil {
+		building = make(map[string]bool)
+	}
+	if building[name] {
+		return nil, errors.New("imsi set " + name + " refers to itself")
+	}
+	building[name] = true
+	defer delete(building, name)
+
+	src, err := newIMSISource(string(spec), func(other string) (IMSISource, error) {
+		return sc.source(other, building)
+	})
+	if err != nil {
+		return nil, errors.New("imsi set " + name + ": " + err.Error())
+	}
+	return src, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// look for the highest rate an hss sustains within its SLOs by running trials at
+// rates between MinRate and MaxRate, halving the range every trial
+type ThroughputSearch struct {
+	MinRate float64 `json:"min_rate"`
+	MaxRate float64 `json:"max_rate"`
+	// how long each trial runs, -search_trial by default
+	Trial Duration `json:"trial"`
+	// stop once the range is narrower than this, 1% of MaxRate by default
+	Precision float64 `json:"precision"`
+	// SLOs a rate has to meet, -slo_failure_rate and -slo_p99 by default
+	MaxFailureRate float64  `json:"max_failure_rate"`
+	MaxP99         Duration `json:"max_p99"`
+}
+
+// one trial of a search
+type Trial struct {
+	Rate        float64
+	FailureRate float64
+	P99         time.Duration
+	Passed      bool
+}
+
+func (s *ThroughputSearch) validate() error {
+	if s.MinRate <= 0 || s.MaxRate <= s.MinRate {
+		return errors.New("search needs 0 < min_rate < max_rate")
+	}
+	if s.Trial < 0 || s.Precision < 0 || s.MaxFailureRate < 0 || s.MaxP99 < 0 {
+		return errors.New("search settings must not be negative")
+	}
+	return nil
+}
+
+// fill in what the scenario left out from the flags
+func (s *ThroughputSearch) withDefaults() ThroughputSearch {
+	search := *s
+	if search.Trial == 0 {
+		search.Trial = Duration(*searchTrial)
+	}
+	if search.Precision == 0 {
+		search.Precision = search.MaxRate / 100
+	}
+	if search.MaxFailureRate == 0 {
+		search.MaxFailureRate = *sloFailureRate
+	}
+	if search.MaxP99 == 0 {
+		search.MaxP99 = Duration(*sloP99)
+	}
+	return search
+}
+
+// binary search the rate of testFunc
+// return: every trial in the order they ran, the highest rate that met the SLOs (0 if none did)
+// parameters: same as runScheduledTest, except for the rates taken from the search
+func (s ThroughputSearch) run(testFunc func([]int, *string, chan int, chan int),
+	imsis IMSISource, numRequestsPerTest int) ([]Trial, float64) {
+	var trials []Trial
+	trial := func(rate float64) bool {
+		result := runScheduledTest(testFunc, imsis, rateSchedule(rate, time.Duration(s.Trial)),
+			numRequestsPerTest, false)
+		t := Trial{Rate: rate, P99: percentile(result.Latencies(), 0.99)}
+		if result.Total > 0 {
+			t.FailureRate = float64(result.Total-result.Successes) / float64(result.Total)
+		}
+		t.Passed = t.FailureRate <= s.MaxFailureRate && t.P99 <= time.Duration(s.MaxP99)
+		trials = append(trials, t)
+		log.Printf("   trial at %.1f/s: failure rate %.2f%%, p99 %v\n", rate, 100*t.FailureRate, t.P99)
+		return t.Passed
+	}
+
+	// the range has to start out sustainable and end unsustainable
+	if !trial(s.MinRate) {
+		return trials, 0
+	}
+	if trial(s.MaxRate) {
+		return trials, s.MaxRate
+	}
+	low, high := s.MinRate, s.MaxRate
+	for high-low > s.Precision {
+		mid := (low + high) / 2
+		if trial(mid) {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return trials, low
+}
+
+// print the outcome of a search
+func printSearchResults(s ThroughputSearch, trials []Trial, best float64) {
+	log.Printf("   SLOs: failure rate <= %.2f%%, p99 <= %v\n", 100*s.MaxFailureRate, time.Duration(s.MaxP99))
+	log.Printf("   Trials: %d of %v\n", len(trials), time.Duration(s.Trial))
+	switch {
+	case best == 0:
+		log.Printf("   Max Sustainable Rate: none, %.1f/s already breaks the SLOs\n", s.MinRate)
+	case best == s.MaxRate:
+		log.Printf("   Max Sustainable Rate: at least %.1f/s, the top of the search\n", best)
+	default:
+		log.Printf("   Max Sustainable Rate: %.1f/s\n", best)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a Session-Id as RFC 6733 8.8 has it: <DiameterIdentity>;<high 32 bits>;<low 32 bits>[;<optional value>]
+// the high 32 bits are when the client started so ids are not reused after a restart,
+// the low 32 bits count up
+type SessionID struct {
+	Host     string
+	High     uint32
+	Low      uint32
+	Optional string
+}
+
+func (s SessionID) String() string {
+	id := s.Host + ";" + strconv.FormatUint(uint64(s.High), 10) + ";" + strconv.FormatUint(uint64(s.Low), 10)
+	if s.Optional != "" {
+		id += ";" + s.Optional
+	}
+	return id
+}
+
+// parse a Session-Id leniently: spaces around the parts are ignored and the optional
+// value may hold more ;'s
+func parseSessionID(id string) (SessionID, error) {
+	parts := strings.SplitN(strings.TrimSpace(id), ";", 4)
+	if len(parts) < 3 || strings.TrimSpace(parts[0]) == "" {
+		return SessionID{}, errors.New("invalid Session-Id " + id)
+	}
+	high, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil {
+		return SessionID{}, errors.New("invalid high 32 bits in Session-Id " + id)
+	}
+	low, err := strconv.ParseUint(strings.TrimSpace(parts[2]), 10, 32)
+	if err != nil {
+		return SessionID{}, errors.New("invalid low 32 bits in Session-Id " + id)
+	}
+	s := SessionID{Host: strings.TrimSpace(parts[0]), High: uint32(high), Low: uint32(low)}
+	if len(parts) == 4 {
+		s.Optional = strings.TrimSpace(parts[3])
+	}
+	return s, nil
+}
+
+// the same Session-Id however it is written, DiameterIdentities are case insensitive
+// ids that do not parse are compared as they are
+func normalizeSessionID(id string) string {
+	s, err := parseSessionID(id)
+	if err != nil {
+		return strings.TrimSpace(id)
+	}
+	s.Host = strings.ToLower(s.Host)
+	return s.String()
+}
+
+var (
+	sessionHigh = uint32(time.Now().Unix())
+	sessionLow  uint32
+	// last sid handed out by nextSID
+	lastSID int64
+
+	sessionLock sync.Mutex
+	// sid to the session of its testFunc, the requests of a testFunc (AIR then ULR,
+	// ULR then PUR...) are one procedure and share it as long as they come from the same host
+	sessions = make(map[int]*session)
+)
+
+// the Session-Ids of a procedure, one per mme host taking part in it: an imsi moving from
+// one mme to another (two_hss) is a new session on the second one, whose Session-Id
+// starts with its own host
+type session struct {
+	// host to its Session-Id, created when the host sends its first request
+	ids map[string]string
+}
+
+// a new sid, unique for as long as the client runs
+func nextSID() int {
+	return int(atomic.AddInt64(&lastSID, 1))
+}
+
+func newSessionID(host string) string {
+	return SessionID{Host: host, High: sessionHigh, Low: atomic.AddUint32(&sessionLow, 1)}.String()
+}
+
+// let the requests of sids share one session
+func openSession(sids []int) {
+	s := &session{make(map[string]string)}
+	sessionLock.Lock()
+	for i := 0; i < len(sids); i++ {
+		sessions[sids[i]] = s
+	}
+	sessionLock.Unlock()
+}
+
+// forget the sessions of sids once nothing more is sent in them
+func closeSessions(sids []int) {
+	sessionLock.Lock()
+	for i := 0; i < len(sids); i++ {
+		delete(sessions, sids[i])
+	}
+	sessionLock.Unlock()
+}
+
+// the Session-Id for host to send the request of sid with, the one host has in the
+// session of the procedure
+func sessionIDFor(sid int, host string) string {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	s, ok := sessions[sid]
+	if !ok {
+		// a lone request
+		s = &session{make(map[string]string)}
+		sessions[sid] = s
+	}
+	id, ok := s.ids[host]
+	if !ok {
+		id = newSessionID(host)
+		s.ids[host] = id
+	}
+	return id
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSessionID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want SessionID
+		ok   bool
+	}{
+		{"mme.test;1;2", SessionID{"mme.test", 1, 2, ""}, true},
+		{"mme.test;4294967295;0;imsi=001010123456789", SessionID{"mme.test", 4294967295, 0, "imsi=001010123456789"}, true},
+		{" mme.test ; 1 ; 2 ; a;b ", SessionID{"mme.test", 1, 2, "a;b"}, true},
+		{"mme.test;1;2;", SessionID{"mme.test", 1, 2, ""}, true},
+		{"mme.test;1", SessionID{}, false},
+		{";1;2", SessionID{}, false},
+		{"mme.test;x;2", SessionID{}, false},
+		{"mme.test;1;-2", SessionID{}, false},
+		{"mme.test;4294967296;2", SessionID{}, false},
+		{"", SessionID{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseSessionID(test.id)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: unexpected error %v", test.id, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: expected %+v got %+v", test.id, test.want, got)
+		}
+	}
+}
+
+func TestNormalizeSessionID(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"mme.test;1;2", "mme.test;1;2"},
+		{"MME.Test;1;2", "mme.test;1;2"},
+		{" mme.test ;01; 2 ;Opt", "mme.test;1;2;Opt"},
+		{"mme.test;1;2;", "mme.test;1;2"},
+		// ids that do not parse are only trimmed
+		{" Not A Session-Id ", "Not A Session-Id"},
+	}
+	for _, test := range tests {
+		if got := normalizeSessionID(test.id); got != test.want {
+			t.Errorf("%q: expected %q got %q", test.id, test.want, got)
+		}
+	}
+	if normalizeSessionID("HSS;1;2") != normalizeSessionID("hss; 1;2") {
+		t.Errorf("the same Session-Id normalizes differently")
+	}
+}
+
+func TestNewSessionID(t *testing.T) {
+	a, b := newSessionID("mme.test"), newSessionID("mme.test")
+	if a == b {
+		t.Fatalf("Session-Id %s reused", a)
+	}
+	s, err := parseSessionID(a)
+	if err != nil || s.Host != "mme.test" || s.High != sessionHigh || s.String() != a {
+		t.Errorf("%s: %+v %v", a, s, err)
+	}
+}
+
+func TestSessionIDFor(t *testing.T) {
+	sids := []int{nextSID(), nextSID(), nextSID()}
+	openSession(sids)
+	defer closeSessions(sids)
+	// the requests of a procedure share a Session-Id as long as they come from the same host
+	a, b, c := sessionIDFor(sids[0], "mme1"), sessionIDFor(sids[1], "mme1"), sessionIDFor(sids[2], "mme2")
+	if a != b || a == c || !strings.HasPrefix(c, "mme2;") {
+		t.Errorf("mme1 %s and %s, mme2 %s", a, b, c)
+	}
+
+	lone := nextSID()
+	defer closeSessions([]int{lone})
+	if d := sessionIDFor(lone, "mme1"); d == a || d != sessionIDFor(lone, "mme1") {
+		t.Errorf("lone request %s", d)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// summary of a set of latencies
+type LatencyStats struct {
+	Count int
+	Min   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+	Max   time.Duration
+}
+
+func newLatencyStats(latencies []time.Duration) LatencyStats {
+	stats := LatencyStats{Count: len(latencies)}
+	if len(latencies) == 0 {
+		return stats
+	}
+	sorted := sortedLatencies(latencies)
+	var sum time.Duration
+	for _, latency := range sorted {
+		sum += latency
+	}
+	stats.Min = sorted[0]
+	stats.Max = sorted[len(sorted)-1]
+	stats.Mean = sum / time.Duration(len(sorted))
+	stats.P50 = rank(sorted, 0.50)
+	stats.P90 = rank(sorted, 0.90)
+	stats.P99 = rank(sorted, 0.99)
+	stats.P999 = rank(sorted, 0.999)
+	return stats
+}
+
+func (stats LatencyStats) String() string {
+	return "n=" + strconv.Itoa(stats.Count) + " min=" + stats.Min.String() + " mean=" + stats.Mean.String() +
+		" p50=" + stats.P50.String() + " p90=" + stats.P90.String() + " p99=" + stats.P99.String() +
+		" p99.9=" + stats.P999.String() + " max=" + stats.Max.String()
+}
+
+// the latency below which the fraction p (0-1) of the latencies are
+// return: 0 if there are no latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	return rank(sortedLatencies(latencies), p)
+}
+
+func sortedLatencies(latencies []time.Duration) []time.Duration {
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	return sorted
+}
+
+// nearest rank percentile of sorted latencies
+func rank(sorted []time.Duration, p float64) time.Duration {
+	r := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if r < 0 {
+		r = 0
+	}
+	if r >= len(sorted) {
+		r = len(sorted) - 1
+	}
+	return sorted[r]
+}
+
+// log-linear latency histogram like HdrHistogram: every power of two microseconds
+// is split into histogramSubBuckets equal buckets, so each bucket is within 1/8
+// of the latencies in it whatever their magnitude
+type Histogram struct {
+	counts map[int]int
+}
+
+const histogramSubBits = 3
+const histogramSubBuckets = 1 << histogramSubBits
+
+func newHistogram(latencies []time.Duration) Histogram {
+	h := Histogram{make(map[int]int)}
+	for _, latency := range latencies {
+		h.counts[histogramBucket(latency)]++
+	}
+	return h
+}
+
+// below 2*histogramSubBuckets us the buckets are 1us wide, above they are
+// histogramSubBuckets per power of two
+func histogramBucket(latency time.Duration) int {
+	us := int64(latency / time.Microsecond)
+	if us < 2*histogramSubBuckets {
+		return int(us)
+	}
+	magnitude := 0
+	for v := us; v >= 2*histogramSubBuckets; v >>= 1 {
+		magnitude++
+	}
+	sub := int(us>>uint(magnitude)) - histogramSubBuckets
+	return (magnitude+1)*histogramSubBuckets + sub
+}
+
+// the latencies of a bucket are from its lower bound up to the next one's
+func histogramLowerBound(bucket int) time.Duration {
+	if bucket < 2*histogramSubBuckets {
+		return time.Duration(bucket) * time.Microsecond
+	}
+	magnitude := bucket/histogramSubBuckets - 1
+	sub := bucket % histogramSubBuckets
+	return time.Duration(int64(histogramSubBuckets+sub)<<uint(magnitude)) * time.Microsecond
+}
+
+// log the non-empty buckets with a bar scaled to the fullest one
+func (h Histogram) print(indent string) {
+	var buckets []int
+	most := 0
+	for bucket, count := range h.counts {
+		buckets = append(buckets, bucket)
+		if count > most {
+			most = count
+		}
+	}
+	sort.Ints(buckets)
+	for _, bucket := range buckets {
+		count := h.counts[bucket]
+		log.Printf("%s[%v, %v): %d %s\n", indent, histogramLowerBound(bucket), histogramLowerBound(bucket+1),
+			count, strings.Repeat("#", (count*40+most-1)/most))
+	}
+}
+
+// the latencies of the answers of a test grouped by key, e.g. by peer
+// return: the groups and their keys in order
+func groupLatencies(answers []Answer, key func(Answer) string) (map[string][]time.Duration, []string) {
+	groups := make(map[string][]time.Duration)
+	var keys []string
+	for _, answer := range answers {
+		k := key(answer)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], answer.Latency)
+	}
+	sort.Strings(keys)
+	return groups, keys
+}
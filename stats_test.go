@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRank(t *testing.T) {
+	ms := func(n ...int) []time.Duration {
+		d := make([]time.Duration, len(n))
+		for i := 0; i < len(n); i++ {
+			d[i] = time.Duration(n[i]) * time.Millisecond
+		}
+		return d
+	}
+	tests := []struct {
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{ms(1), 0.5, time.Millisecond},
+		{ms(1, 2, 3, 4), 0, time.Millisecond},
+		{ms(1, 2, 3, 4), 0.25, time.Millisecond},
+		{ms(1, 2, 3, 4), 0.26, 2 * time.Millisecond},
+		{ms(1, 2, 3, 4), 0.5, 2 * time.Millisecond},
+		{ms(1, 2, 3, 4), 0.99, 4 * time.Millisecond},
+		{ms(1, 2, 3, 4), 1, 4 * time.Millisecond},
+		{ms(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), 0.9, 9 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := rank(test.sorted, test.p); got != test.want {
+			t.Errorf("p%v of %v: expected %v got %v", test.p*100, test.sorted, test.want, got)
+		}
+	}
+	if percentile(nil, 0.5) != 0 || percentile(ms(3, 1, 2), 0.5) != 2*time.Millisecond {
+		t.Errorf("percentile of unsorted latencies")
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1000; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Microsecond)
+	}
+	s := newLatencyStats(latencies)
+	if s.Count != 1000 || s.Min != time.Microsecond || s.Max != time.Millisecond ||
+		s.P50 != 500*time.Microsecond || s.P90 != 900*time.Microsecond ||
+		s.P99 != 990*time.Microsecond || s.P999 != 999*time.Microsecond || s.Mean != 500500*time.Nanosecond {
+		t.Errorf("%v", s)
+	}
+	if s := newLatencyStats(nil); s.Count != 0 || s.Max != 0 {
+		t.Errorf("no latencies: %v", s)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	tests := []struct {
+		latency time.Duration
+		bucket  int
+	}{
+		{0, 0},
+		{15 * time.Microsecond, 15},
+		{16 * time.Microsecond, 16},
+		{17 * time.Microsecond, 16},
+		{18 * time.Microsecond, 17},
+		{31 * time.Microsecond, 23},
+		{32 * time.Microsecond, 24},
+		{time.Millisecond, 63},
+	}
+	for _, test := range tests {
+		if got := histogramBucket(test.latency); got != test.bucket {
+			t.Errorf("%v: expected bucket %d got %d", test.latency, test.bucket, got)
+		}
+	}
+
+	// every latency is in the bucket whose bounds hold it, and buckets are within 1/8 of it
+	for us := int64(0); us < 1<<20; us += 1 + us/50 {
+		latency := time.Duration(us) * time.Microsecond
+		b := histogramBucket(latency)
+		low, high := histogramLowerBound(b), histogramLowerBound(b+1)
+		if latency < low || latency >= high {
+			t.Fatalf("%v in bucket %d [%v, %v)", latency, b, low, high)
+		}
+		if high-low > time.Microsecond && high-low > low/histogramSubBuckets {
+			t.Fatalf("bucket %d [%v, %v) is too wide", b, low, high)
+		}
+	}
+
+	h := newHistogram([]time.Duration{time.Millisecond, time.Millisecond, 1010 * time.Microsecond, 5 * time.Microsecond})
+	if len(h.counts) != 2 || h.counts[histogramBucket(time.Millisecond)] != 3 || h.counts[5] != 1 {
+		t.Errorf("%v", h.counts)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/dict"
+	"github.com/fiorix/go-diameter/diam/sm"
+)
+
+// an Insert-Subscriber-Data or Delete-Subscriber-Data Request the HSS sent to one of our mme's
+type SubscriberDataUpdate struct {
+	Command          string
+	IMSI             string
+	SubscriptionData SubscriptionData // IDR only
+	// the fields of SubscriptionData the IDR carries, see flattenSubscriptionData
+	Fields             map[string]string
+	IDRFlags           uint32
+	DSRFlags           uint32
+	ContextIdentifiers []uint32 // DSR only
+	MME                string
+	HSS                net.Addr
+	Time               time.Time
+}
+
+// how the mme answers an HSS initiated request
+type AnswerConfig struct {
+	ResultCode       uint32
+	ExperimentalCode uint32
+	Delay            time.Duration
+	NoAnswer         bool
+}
+
+var (
+	subscriberDataLock    sync.Mutex
+	subscriberDataUpdates []SubscriberDataUpdate
+)
+
+// parse the answer flags of an HSS initiated request
+// mode is one of success, user_unknown or none (never answer)
+func parseAnswerConfig(mode string, delay time.Duration) (AnswerConfig, error) {
+	switch mode {
+	case "success":
+		return AnswerConfig{ResultCode: 2001, Delay: delay}, nil
+	case "user_unknown":
+		return AnswerConfig{ExperimentalCode: DIAMETER_ERROR_USER_UNKNOWN, Delay: delay}, nil
+	case "none":
+		return AnswerConfig{NoAnswer: true}, nil
+	}
+	return AnswerConfig{}, errors.New("unknown answer " + mode + ", must be success, user_unknown or none")
+}
+
+// Handle IDR
+// records the pushed Subscription-Data and answers as configured
+// parameters: cfg of the mme the request was sent to, how to answer
+func handleInsertSubscriberDataRequest(cfg *sm.Settings, answer AnswerConfig) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Insert-Subscriber-Data Request from %s\n%s\n", c.RemoteAddr(), m)
+		var idr IDR
+		err := m.Unmarshal(&idr)
+		if err != nil {
+			log.Printf("IDR Unmarshal failed: %s", err)
+			return
+		}
+		recordSubscriberDataUpdate(SubscriberDataUpdate{
+			Command:          "IDR",
+			IMSI:             idr.UserName,
+			SubscriptionData: idr.SubscriptionData,
+			Fields:           carriedFields(m, idr.SubscriptionData),
+			IDRFlags:         idr.IDRFlags,
+			MME:              string(cfg.OriginHost),
+			HSS:              c.RemoteAddr(),
+			Time:             time.Now(),
+		})
+		sendSubscriberDataAnswer(c, m, cfg, idr.SessionID, answer)
+	}
+}
+
+// Handle DSR
+// records what the HSS withdrew and answers as configured
+// parameters: cfg of the mme the request was sent to, how to answer
+func handleDeleteSubscriberDataRequest(cfg *sm.Settings, answer AnswerConfig) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Delete-Subscriber-Data Request from %s\n%s\n", c.RemoteAddr(), m)
+		var dsr DSR
+		err := m.Unmarshal(&dsr)
+		if err != nil {
+			log.Printf("DSR Unmarshal failed: %s", err)
+			return
+		}
+		recordSubscriberDataUpdate(SubscriberDataUpdate{
+			Command:            "DSR",
+			IMSI:               dsr.UserName,
+			DSRFlags:           dsr.DSRFlags,
+			ContextIdentifiers: dsr.ContextIdentifiers,
+			MME:                string(cfg.OriginHost),
+			HSS:                c.RemoteAddr(),
+			Time:               time.Now(),
+		})
+		sendSubscriberDataAnswer(c, m, cfg, dsr.SessionID, answer)
+	}
+}
+
+// answer in another goroutine, handlers run on the connection's read loop
+// and a delayed answer must not hold up everything else the HSS sends
+func sendSubscriberDataAnswer(c diam.Conn, m *diam.Message, cfg *sm.Settings, sessionID string, answer AnswerConfig) {
+	if answer.NoAnswer {
+		return
+	}
+	a := newS6aAnswer(m, cfg, sessionID, answer.ResultCode, answer.ExperimentalCode)
+	go func() {
+		time.Sleep(answer.Delay)
+		// log.Printf("\nSending answer to %s\n%s\n", c.RemoteAddr(), a)
+		_, err := a.WriteTo(c)
+		if err != nil {
+			log.Printf("failed to answer %s: %s", c.RemoteAddr(), err)
+		}
+	}()
+}
+
+func recordSubscriberDataUpdate(update SubscriberDataUpdate) {
+	subscriberDataLock.Lock()
+	subscriberDataUpdates = append(subscriberDataUpdates, update)
+	subscriberDataLock.Unlock()
+}
+
+// return: the IDRs/DSRs (command) received for imsi since the given time
+func subscriberDataUpdatesOf(command string, imsi string, since time.Time) []SubscriberDataUpdate {
+	var found []SubscriberDataUpdate
+	subscriberDataLock.Lock()
+	defer subscriberDataLock.Unlock()
+	for i := 0; i < len(subscriberDataUpdates); i++ {
+		u := subscriberDataUpdates[i]
+		if u.Command == command && u.IMSI == imsi && !u.Time.Before(since) {
+			found = append(found, u)
+		}
+	}
+	return found
+}
+
+// print how many IDRs/DSRs each mme received since the given time
+func printSubscriberDataUpdates(index int, testName string, since time.Time) {
+	counts := make(map[string]int)
+	subscriberDataLock.Lock()
+	for i := 0; i < len(subscriberDataUpdates); i++ {
+		if !subscriberDataUpdates[i].Time.Before(since) {
+			counts[subscriberDataUpdates[i].Command]++
+		}
+	}
+	subscriberDataLock.Unlock()
+	log.Printf("%d. %s:", index, testName)
+	log.Printf("   IDRs: %d\n", counts["IDR"])
+	log.Printf("   DSRs: %d\n", counts["DSR"])
+}
+
+// an IDR only carries the parts of the Subscription-Data that changed, so only the fields
+// under its top level AVPs count
+func carriedFields(m *diam.Message, data SubscriptionData) map[string]string {
+	carried := make(map[string]bool)
+	if a, err := m.FindAVP(avp.SubscriptionData, uint32(*vendorID)); err == nil {
+		if group, ok := a.Data.(*diam.GroupedAVP); ok {
+			for _, child := range group.AVP {
+				d, err := dict.Default.FindAVPWithVendor(diam.TGPP_S6A_APP_ID, child.Code, child.VendorID)
+				if err == nil {
+					carried[d.Name] = true
+				}
+			}
+		}
+	}
+	fields := make(map[string]string)
+	for field, value := range flattenSubscriptionData(data) {
+		if carried[strings.SplitN(field, ".", 2)[0]] {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+// check the Subscription-Data of the IDRs received since the given time against the
+// expected fields of their subscribers, the fields an IDR does not carry are not checked
+// return: the number of IDRs checked, one line per IDR that got a field wrong
+func checkSubscriberDataUpdates(since time.Time) (int, []string) {
+	checked := 0
+	var problems []string
+	for _, sub := range subscribers {
+		if len(sub.Expected) == 0 {
+			continue
+		}
+		for _, u := range subscriberDataUpdatesOf("IDR", sub.IMSI, since) {
+			checked++
+			expected := make(map[string]string)
+			for field, value := range sub.Expected {
+				if _, ok := u.Fields[field]; ok {
+					expected[field] = value
+				}
+			}
+			diffs := diffFields(expected, u.Fields)
+			if len(diffs) == 0 {
+				continue
+			}
+			var lines []string
+			for _, d := range diffs {
+				lines = append(lines, d.String())
+			}
+			problem := fmt.Sprintf("IDR for %s from %s: %s", sub.IMSI, peerName(u.HSS), strings.Join(lines, ", "))
+			log.Printf("   %s\n", problem)
+			problems = append(problems, problem)
+		}
+	}
+	log.Printf("   IDRs checked against the subscriber file: %d, wrong: %d\n", checked, len(problems))
+	return checked, problems
+}
+
+// 3GPP Experimental-Result-Code for a subscriber the receiver does not know
+const DIAMETER_ERROR_USER_UNKNOWN = 5001
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a provisioned subscriber, what the hss is expected to answer for it
+// every field but the imsi is optional, unset fields are not checked
+type Subscriber struct {
+	IMSI string
+	Keys *MilenageKeys
+	AMF  []byte
+	APNs []string
+	// granted, barred or unknown
+	Status string
+	// AVP path to the value expected in the Subscription-Data of its ULAs,
+	// see flattenSubscriptionData
+	Expected map[string]string
+}
+
+// Subscriber-Status values (TS 29.272 7.3.29)
+const (
+	SERVICE_GRANTED             = 0
+	OPERATOR_DETERMINED_BARRING = 1
+)
+
+var (
+	// loaded with -subscribers or from a scenario, in file order
+	subscribers []*Subscriber
+	// imsi to subscriber
+	subscribersByIMSI = make(map[string]*Subscriber)
+
+	subscriberLock sync.Mutex
+	// sid of an outstanding ULR/AIR to the subscriber it was sent for
+	pendingSubscribers = make(map[int]*Subscriber)
+)
+
+// load a CSV subscriber file, e.g. an hss provisioning export
+// the first line is a header naming the columns, imsi is required and
+// ki, opc, amf, msisdn, apns (separated by ;), status and the columns of
+// expectedFieldColumns are optional
+// a column named after an AVP path, which start with a capital letter, is
+// the expected value of that field, any other column is ignored
+func loadSubscribers(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	header, err := r.Read()
+	if err != nil {
+		return errors.New(path + ": missing header")
+	}
+	columns := make(map[string]int)
+	for i := 0; i < len(header); i++ {
+		columns[strings.ToLower(strings.TrimSpace(header[i]))] = i
+	}
+	if _, ok := columns["imsi"]; !ok {
+		return errors.New(path + ": missing imsi column")
+	}
+
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sub, err := parseSubscriber(record, header, columns)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if _, ok := subscribersByIMSI[sub.IMSI]; ok {
+			return fmt.Errorf("%s:%d: duplicate imsi %s", path, line, sub.IMSI)
+		}
+		subscribers = append(subscribers, sub)
+		subscribersByIMSI[sub.IMSI] = sub
+	}
+}
+
+func parseSubscriber(record []string, header []string, columns map[string]int) (*Subscriber, error) {
+	column := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	sub := &Subscriber{IMSI: column("imsi"), Status: strings.ToLower(column("status")),
+		Expected: make(map[string]string)}
+	if !isIMSI(sub.IMSI) {
+		return nil, errors.New("invalid imsi " + sub.IMSI)
+	}
+	keys, err := parseMilenageKeys(column("ki"), column("opc"))
+	if err != nil {
+		return nil, err
+	}
+	sub.Keys = keys
+	if amf := column("amf"); amf != "" {
+		sub.AMF, err = hex.DecodeString(amf)
+		if err != nil || len(sub.AMF) != 2 {
+			return nil, errors.New("AMF must be 4 hex characters")
+		}
+	}
+	for _, apn := range strings.Split(column("apns"), ";") {
+		if apn = strings.TrimSpace(apn); apn != "" {
+			sub.APNs = append(sub.APNs, apn)
+		}
+	}
+	switch sub.Status {
+	case "", "unknown":
+	case "granted":
+		sub.Expected["Subscriber-Status"] = strconv.Itoa(SERVICE_GRANTED)
+	case "barred":
+		sub.Expected["Subscriber-Status"] = strconv.Itoa(OPERATOR_DETERMINED_BARRING)
+	default:
+		return nil, errors.New("status must be granted, barred or unknown, not " + sub.Status)
+	}
+
+	for name, field := range expectedFieldColumns {
+		if value := column(name); value != "" {
+			sub.Expected[field] = value
+		}
+	}
+	for i := 0; i < len(header) && i < len(record); i++ {
+		field := strings.TrimSpace(header[i])
+		if field != "" && field[0] >= 'A' && field[0] <= 'Z' && strings.TrimSpace(record[i]) != "" {
+			sub.Expected[field] = strings.TrimSpace(record[i])
+		}
+	}
+	return sub, nil
+}
+
+// return: the imsis of every loaded subscriber, in file order
+func subscriberIMSIs() []string {
+	imsis := make([]string, len(subscribers))
+	for i := 0; i < len(subscribers); i++ {
+		imsis[i] = subscribers[i].IMSI
+	}
+	return imsis
+}
+
+// remember which subscriber the ULR/AIR of sid is for, so its answer can be checked
+func trackSubscriber(sid int, imsi string) {
+	sub, ok := subscribersByIMSI[imsi]
+	if !ok {
+		return
+	}
+	subscriberLock.Lock()
+	pendingSubscribers[sid] = sub
+	subscriberLock.Unlock()
+}
+
+// return: the subscriber the request of sid was sent for, nil if it is not in the subscriber file
+func subscriberOf(sid int) *Subscriber {
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+	sub := pendingSubscribers[sid]
+	delete(pendingSubscribers, sid)
+	return sub
+}
+
+// the keys to check the vectors of sub with, the -ki/-opc ones if it has none
+func (sub *Subscriber) keys() *MilenageKeys {
+	if sub != nil && sub.Keys != nil {
+		return sub.Keys
+	}
+	return authKeys
+}
+
+// compare what a successful or failed ULA says about sub with the subscriber file
+// return: one line per mismatch, empty if the ULA is what was expected
+func (sub *Subscriber) ulaMismatches(ula ULA) []string {
+	var mismatches []string
+	success := ula.ResultCode == 0x7d1
+	if sub.Status == "unknown" {
+		if success {
+			mismatches = append(mismatches, "unknown subscriber was registered")
+		}
+		return mismatches
+	}
+	if !success {
+		if sub.Status != "" {
+			mismatches = append(mismatches, fmt.Sprintf("expected success, got result %d experimental result %d",
+				ula.ResultCode, ula.ExperimentalResult.ExperimentalResultCode))
+		}
+		return mismatches
+	}
+
+	data := ula.SubscriptionData
+	diffs := diffSubscriptionData(sub.Expected, data)
+	recordFieldDiffs(diffs)
+	for i := 0; i < len(diffs); i++ {
+		mismatches = append(mismatches, diffs[i].String())
+	}
+	// the hss has to send exactly the provisioned APNs
+	if len(sub.APNs) != 0 {
+		got := apnNames(data.APNConfigurationProfile)
+		if !sameAPNs(sub.APNs, got) {
+			mismatches = append(mismatches, fmt.Sprintf("APNs expected %s got %s",
+				strings.Join(sub.APNs, ";"), strings.Join(got, ";")))
+		}
+	}
+	return mismatches
+}
+
+// whether both lists have the same APNs, in any order
+func sameAPNs(expected []string, got []string) bool {
+	if len(expected) != len(got) {
+		return false
+	}
+	seen := make(map[string]int)
+	for i := 0; i < len(expected); i++ {
+		seen[strings.ToLower(expected[i])]++
+	}
+	for i := 0; i < len(got); i++ {
+		name := strings.ToLower(got[i])
+		if seen[name] == 0 {
+			return false
+		}
+		seen[name]--
+	}
+	return true
+}
+
+// decode a TBCD string (TS 29.002), e.g. an MSISDN: two digits per byte,
+// low nibble first, padded with 0xf
+func decodeTBCD(b []byte) string {
+	const digits = "0123456789*#abc"
+	var s []byte
+	for i := 0; i < len(b); i++ {
+		for _, nibble := range []byte{b[i] & 0x0f, b[i] >> 4} {
+			if nibble == 0x0f {
+				return string(s)
+			}
+			s = append(s, digits[nibble])
+		}
+	}
+	return string(s)
+}
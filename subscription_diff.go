@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// a field of the Subscription-Data of a ULA that is not what the subscriber file expects
+type FieldDiff struct {
+	// AVP path of the field, see flattenSubscriptionData
+	Field    string
+	Expected string
+	Got      string
+}
+
+// short subscriber file columns for the usual expected fields, any column named
+// after an AVP path (e.g. APN-Configuration-Profile.APN-Configuration[oai.ipv4].PDN-Type)
+// is an expected field too
+var expectedFieldColumns = map[string]string{
+	"msisdn":          "MSISDN",
+	"nam":             "Network-Access-Mode",
+	"ambr_ul":         "AMBR.Max-Requested-Bandwidth-UL",
+	"ambr_dl":         "AMBR.Max-Requested-Bandwidth-DL",
+	"tau_timer":       "Subscribed-Periodic-RAU-TAU-Timer",
+	"default_context": "APN-Configuration-Profile.Context-Identifier",
+}
+
+var (
+	fieldDiffLock sync.Mutex
+	// AVP path to number of ULAs it was wrong in, since the last printFieldDiffs
+	fieldDiffCounts = make(map[string]int)
+	// APN to number of successful ULAs it was in, since the last printAPNs
+	apnCounts = make(map[string]int)
+)
+
+// the fields of a Subscription-Data by AVP path, with enumerated and integer values
+// in decimal and the MSISDN decoded
+// an APN configuration is keyed by its Service-Selection, e.g.
+// APN-Configuration-Profile.APN-Configuration[oai.ipv4].EPS-Subscribed-QoS-Profile.QoS-Class-Identifier
+// optional AVPs, of the Subscription-Data or an APN configuration, are only there if the hss sent them
+func flattenSubscriptionData(data SubscriptionData) map[string]string {
+	u := func(v uint32) string { return strconv.FormatUint(uint64(v), 10) }
+	i := func(v int32) string { return strconv.FormatInt(int64(v), 10) }
+
+	// the optional ones are left out when absent, so that diffFields reports them
+	// as <absent> instead of 0
+	fields := make(map[string]string)
+	if len(data.MSISDN) != 0 {
+		fields["MSISDN"] = decodeTBCD([]byte(data.MSISDN))
+	}
+	if data.AccessRestrictionData != nil {
+		fields["Access-Restriction-Data"] = u(*data.AccessRestrictionData)
+	}
+	if data.SubscriberStatus != nil {
+		fields["Subscriber-Status"] = i(*data.SubscriberStatus)
+	}
+	if data.NetworkAccessMode != nil {
+		fields["Network-Access-Mode"] = i(*data.NetworkAccessMode)
+	}
+	if data.AMBR != nil {
+		fields["AMBR.Max-Requested-Bandwidth-UL"] = u(data.AMBR.MaxRequestedBandwidthUL)
+		fields["AMBR.Max-Requested-Bandwidth-DL"] = u(data.AMBR.MaxRequestedBandwidthDL)
+	}
+	if data.SubscribedPeriodicRauTauTimer != nil {
+		fields["Subscribed-Periodic-RAU-TAU-Timer"] = u(*data.SubscribedPeriodicRauTauTimer)
+	}
+
+	profile := data.APNConfigurationProfile
+	fields["APN-Configuration-Profile.Context-Identifier"] = u(profile.ContextIdentifier)
+	fields["APN-Configuration-Profile.All-APN-Configurations-Included-Indicator"] =
+		i(profile.AllAPNConfigurationsIncludedIndicator)
+
+	for _, apn := range profile.APNConfigurations {
+		prefix := "APN-Configuration-Profile.APN-Configuration[" + apn.ServiceSelection + "]."
+		qos := apn.EPSSubscribedQoSProfile
+		fields[prefix+"Context-Identifier"] = u(apn.ContextIdentifier)
+		fields[prefix+"PDN-Type"] = i(apn.PDNType)
+		fields[prefix+"EPS-Subscribed-QoS-Profile.QoS-Class-Identifier"] = i(qos.QoSClassIdentifier)
+		fields[prefix+"EPS-Subscribed-QoS-Profile.Allocation-Retention-Priority.Priority-Level"] =
+			u(qos.AllocationRetentionPriority.PriorityLevel)
+		fields[prefix+"EPS-Subscribed-QoS-Profile.Allocation-Retention-Priority.Pre-emption-Capability"] =
+			i(qos.AllocationRetentionPriority.PreemptionCapability)
+		fields[prefix+"EPS-Subscribed-QoS-Profile.Allocation-Retention-Priority.Pre-emption-Vulnerability"] =
+			i(qos.AllocationRetentionPriority.PreemptionVulnerability)
+		fields[prefix+"AMBR.Max-Requested-Bandwidth-UL"] = u(apn.AMBR.MaxRequestedBandwidthUL)
+		fields[prefix+"AMBR.Max-Requested-Bandwidth-DL"] = u(apn.AMBR.MaxRequestedBandwidthDL)
+
+		// optional ones are left out when absent
+		if len(apn.ServedPartyIPAddresses) != 0 {
+			fields[prefix+"Served-Party-IP-Address"] = joinAddresses(apn.ServedPartyIPAddresses)
+		}
+		if apn.VPLMNDynamicAddressAllowed != nil {
+			fields[prefix+"VPLMN-Dynamic-Address-Allowed"] = i(*apn.VPLMNDynamicAddressAllowed)
+		}
+		if apn.PDNGWAllocationType != nil {
+			fields[prefix+"PDN-GW-Allocation-Type"] = i(*apn.PDNGWAllocationType)
+		}
+		if apn.ChargingCharacteristics != nil {
+			fields[prefix+"TGPP-Charging-Characteristics"] = *apn.ChargingCharacteristics
+		}
+		if agent := apn.MIP6AgentInfo; agent != nil {
+			if len(agent.MIPHomeAgentAddresses) != 0 {
+				fields[prefix+"MIP6-Agent-Info.MIP-Home-Agent-Address"] = joinAddresses(agent.MIPHomeAgentAddresses)
+			}
+			if agent.MIPHomeAgentHost != nil {
+				fields[prefix+"MIP6-Agent-Info.MIP-Home-Agent-Host.Destination-Host"] =
+					string(agent.MIPHomeAgentHost.DestinationHost)
+				fields[prefix+"MIP6-Agent-Info.MIP-Home-Agent-Host.Destination-Realm"] =
+					string(agent.MIPHomeAgentHost.DestinationRealm)
+			}
+		}
+	}
+	return fields
+}
+
+// compare the expected fields with the Subscription-Data of a ULA
+// return: the fields that differ, sorted by AVP path
+func diffSubscriptionData(expected map[string]string, data SubscriptionData) []FieldDiff {
+	return diffFields(expected, flattenSubscriptionData(data))
+}
+
+func diffFields(expected map[string]string, fields map[string]string) []FieldDiff {
+	var diffs []FieldDiff
+	for field, want := range expected {
+		got, ok := fields[field]
+		if !ok {
+			got = "<absent>"
+		}
+		if got != want {
+			diffs = append(diffs, FieldDiff{field, want, got})
+		}
+	}
+	sort.Slice(diffs, func(a, b int) bool { return diffs[a].Field < diffs[b].Field })
+	return diffs
+}
+
+// the APNs of a profile, in the order the hss sent them
+func apnNames(profile APNConfigurationProfile) []string {
+	names := make([]string, len(profile.APNConfigurations))
+	for i := 0; i < len(profile.APNConfigurations); i++ {
+		names[i] = profile.APNConfigurations[i].ServiceSelection
+	}
+	return names
+}
+
+// problems of a profile no matter who the subscriber is: every APN configuration needs
+// its own Context-Identifier and the default one has to be among them (TS 29.272 7.3.34)
+// return: one line per problem, empty if the profile is fine
+func apnProfileProblems(profile APNConfigurationProfile) []string {
+	var problems []string
+	if len(profile.APNConfigurations) == 0 {
+		return problems
+	}
+	contexts := make(map[uint32]bool)
+	for _, apn := range profile.APNConfigurations {
+		if contexts[apn.ContextIdentifier] {
+			problems = append(problems, fmt.Sprintf("APN %s reuses Context-Identifier %d",
+				apn.ServiceSelection, apn.ContextIdentifier))
+		}
+		contexts[apn.ContextIdentifier] = true
+	}
+	if !contexts[profile.ContextIdentifier] {
+		problems = append(problems, fmt.Sprintf("default Context-Identifier %d is not one of the APN configurations",
+			profile.ContextIdentifier))
+	}
+	return problems
+}
+
+func joinAddresses(addrs []datatype.Address) string {
+	s := make([]string, len(addrs))
+	for i := 0; i < len(addrs); i++ {
+		s[i] = net.IP(addrs[i]).String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (d FieldDiff) String() string {
+	return fmt.Sprintf("%s expected %s got %s", d.Field, d.Expected, d.Got)
+}
+
+func recordFieldDiffs(diffs []FieldDiff) {
+	fieldDiffLock.Lock()
+	for i := 0; i < len(diffs); i++ {
+		fieldDiffCounts[diffs[i].Field]++
+	}
+	fieldDiffLock.Unlock()
+}
+
+// print how many ULAs got each field wrong since the last call, nothing if none did
+func printFieldDiffs() {
+	fieldDiffLock.Lock()
+	defer fieldDiffLock.Unlock()
+	if len(fieldDiffCounts) == 0 {
+		return
+	}
+	var fields []string
+	for field := range fieldDiffCounts {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	log.Printf("   Subscription-Data diffs:\n")
+	for _, field := range fields {
+		log.Printf("      %s: %d\n", field, fieldDiffCounts[field])
+	}
+	fieldDiffCounts = make(map[string]int)
+}
+
+func recordAPNs(apns []string) {
+	fieldDiffLock.Lock()
+	for i := 0; i < len(apns); i++ {
+		apnCounts[apns[i]]++
+	}
+	fieldDiffLock.Unlock()
+}
+
+// print the APNs of the successful ULAs since the last call, nothing if there were none
+func printAPNs() {
+	fieldDiffLock.Lock()
+	defer fieldDiffLock.Unlock()
+	if len(apnCounts) == 0 {
+		return
+	}
+	var apns []string
+	for apn := range apnCounts {
+		apns = append(apns, apn)
+	}
+	sort.Strings(apns)
+	log.Printf("   APNs:\n")
+	for _, apn := range apns {
+		log.Printf("      %s: %d\n", apn, apnCounts[apn])
+	}
+	apnCounts = make(map[string]int)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// a ULA with the MSISDN, Network-Access-Mode and AMBR of its Subscription-Data
+// and one APN configuration with a PDN GW allocation type
+func testULA() *diam.Message {
+	m := diam.NewRequest(diam.UpdateLocation, diam.TGPP_S6A_APP_ID, dict.Default).Answer(2001)
+	apn := diam.NewAVP(avp.APNConfiguration, avp.Mbit|avp.Vbit, 10415, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.ContextIdentifier, avp.Mbit|avp.Vbit, 10415, datatype.Unsigned32(1)),
+		diam.NewAVP(avp.PDNType, avp.Mbit|avp.Vbit, 10415, datatype.Enumerated(0)),
+		diam.NewAVP(avp.ServiceSelection, avp.Mbit, 0, datatype.UTF8String("oai.ipv4")),
+		diam.NewAVP(avp.ServedPartyIPAddress, avp.Mbit|avp.Vbit, 10415, datatype.Address(net.ParseIP("10.0.0.1").To4())),
+		diam.NewAVP(avp.PDNGWAllocationType, avp.Mbit|avp.Vbit, 10415, datatype.Enumerated(1)),
+	}})
+	m.NewAVP(avp.SubscriptionData, avp.Mbit|avp.Vbit, 10415, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.MSISDN, avp.Mbit|avp.Vbit, 10415, datatype.OctetString("\x33\x36\x08\x02\x00\xf0")),
+		diam.NewAVP(avp.NetworkAccessMode, avp.Mbit|avp.Vbit, 10415, datatype.Enumerated(2)),
+		diam.NewAVP(avp.AMBR, avp.Mbit|avp.Vbit, 10415, &diam.GroupedAVP{AVP: []*diam.AVP{
+			diam.NewAVP(avp.MaxRequestedBandwidthUL, avp.Mbit|avp.Vbit, 10415, datatype.Unsigned32(50000000)),
+			diam.NewAVP(avp.MaxRequestedBandwidthDL, avp.Mbit|avp.Vbit, 10415, datatype.Unsigned32(100000000)),
+		}}),
+		diam.NewAVP(avp.APNConfigurationProfile, avp.Mbit|avp.Vbit, 10415, &diam.GroupedAVP{AVP: []*diam.AVP{
+			diam.NewAVP(avp.ContextIdentifier, avp.Mbit|avp.Vbit, 10415, datatype.Unsigned32(1)),
+			diam.NewAVP(avp.AllAPNConfigurationsIncludedIndicator, avp.Mbit|avp.Vbit, 10415, datatype.Enumerated(0)),
+			apn,
+		}}),
+	}})
+	return m
+}
+
+func TestFlattenSubscriptionData(t *testing.T) {
+	var ula ULA
+	if err := testULA().Unmarshal(&ula); err != nil {
+		t.Fatal(err)
+	}
+	apn := "APN-Configuration-Profile.APN-Configuration[oai.ipv4]."
+	want := map[string]string{
+		"MSISDN":                                       "33638020000",
+		"Network-Access-Mode":                          "2",
+		"AMBR.Max-Requested-Bandwidth-UL":              "50000000",
+		"AMBR.Max-Requested-Bandwidth-DL":              "100000000",
+		"APN-Configuration-Profile.Context-Identifier": "1",
+		"APN-Configuration-Profile.All-APN-Configurations-Included-Indicator": "0",
+		apn + "Context-Identifier":                              "1",
+		apn + "PDN-Type":                                        "0",
+		apn + "Served-Party-IP-Address":                         "10.0.0.1",
+		apn + "PDN-GW-Allocation-Type":                          "1",
+		apn + "EPS-Subscribed-QoS-Profile.QoS-Class-Identifier": "0",
+		apn + "EPS-Subscribed-QoS-Profile.Allocation-Retention-Priority.Priority-Level":            "0",
+		apn + "EPS-Subscribed-QoS-Profile.Allocation-Retention-Priority.Pre-emption-Capability":    "0",
+		apn + "EPS-Subscribed-QoS-Profile.Allocation-Retention-Priority.Pre-emption-Vulnerability": "0",
+		apn + "AMBR.Max-Requested-Bandwidth-UL":                                                    "0",
+		apn + "AMBR.Max-Requested-Bandwidth-DL":                                                    "0",
+	}
+	fields := flattenSubscriptionData(ula.SubscriptionData)
+	for field, value := range want {
+		if fields[field] != value {
+			t.Errorf("%s: expected %q got %q", field, value, fields[field])
+		}
+	}
+	// optional AVPs the hss did not send are not there, rather than 0
+	for field := range fields {
+		if _, ok := want[field]; !ok {
+			t.Errorf("unexpected field %s=%s", field, fields[field])
+		}
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	fields := map[string]string{"MSISDN": "33638020000", "Network-Access-Mode": "2", "Subscriber-Status": "0"}
+	expected := map[string]string{
+		"MSISDN":                            "33638020000",
+		"Network-Access-Mode":               "0",
+		"Subscribed-Periodic-RAU-TAU-Timer": "0",
+	}
+	diffs := diffFields(expected, fields)
+	want := []FieldDiff{
+		{"Network-Access-Mode", "0", "2"},
+		{"Subscribed-Periodic-RAU-TAU-Timer", "0", "<absent>"},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("expected %v got %v", want, diffs)
+	}
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Errorf("expected %v got %v", want[i], diffs[i])
+		}
+	}
+	if len(diffFields(nil, fields)) != 0 {
+		t.Errorf("diffs without expected fields")
+	}
+}
+
+func TestAPNProfileProblems(t *testing.T) {
+	profile := APNConfigurationProfile{ContextIdentifier: 3, APNConfigurations: []APNConfiguration{
+		{ContextIdentifier: 1, ServiceSelection: "internet"},
+		{ContextIdentifier: 1, ServiceSelection: "ims"},
+	}}
+	if problems := apnProfileProblems(profile); len(problems) != 2 {
+		t.Errorf("%v", problems)
+	}
+	profile.ContextIdentifier = 1
+	profile.APNConfigurations[1].ContextIdentifier = 2
+	if problems := apnProfileProblems(profile); len(problems) != 0 {
+		t.Errorf("%v", problems)
+	}
+	if names := apnNames(profile); len(names) != 2 || names[0] != "internet" || names[1] != "ims" {
+		t.Errorf("%v", names)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -10,71 +9,236 @@ import (
 
 var lock sync.Mutex
 
+var (
+	resultsLock sync.Mutex
+	// closed once the running test stops reading received, closed between tests
+	resultsDone = closedChannel()
+)
+
+func closedChannel() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// send the result of an answer to the running test, dropping it if no test is reading
+// received any more so the handler doesn't block the connection it was read from
+func sendResult(received chan ReceivedResult, r ReceivedResult) {
+	resultsLock.Lock()
+	done := resultsDone
+	resultsLock.Unlock()
+	select {
+	case received <- r:
+	case <-done:
+	}
+}
+
+// when each testFunc of a test starts
+type Schedule struct {
+	// number of times testFunc is called
+	Count int
+	// starts going through when each testFunc starts, relative to the start of the test,
+	// in order: the returned func gives the next offset, false once all Count are given
+	Offsets func() func() (time.Duration, bool)
+}
+
+// offsets of a schedule where testFunc i starts at offset(i)
+func countedOffsets(count int, offset func(i int) time.Duration) func() func() (time.Duration, bool) {
+	return func() func() (time.Duration, bool) {
+		i := 0
+		return func() (time.Duration, bool) {
+			if i >= count {
+				return 0, false
+			}
+			i++
+			return offset(i - 1), true
+		}
+	}
+}
+
+// all testFuncs at once, how the load tests started out
+func burstSchedule(numRequests int) Schedule {
+	return Schedule{numRequests, countedOffsets(numRequests, func(i int) time.Duration { return 0 })}
+}
+
+// open loop: rate testFuncs per second for duration, no matter how long answers take
+func rateSchedule(rate float64, duration time.Duration) Schedule {
+	count := int(rate * duration.Seconds())
+	return Schedule{count, countedOffsets(count, func(i int) time.Duration {
+		return time.Duration(float64(i) / rate * float64(time.Second))
+	})}
+}
+
+// what came out of a test
+type TestResult struct {
+	Successes int
+	Failures  int
+	// number of requests the test was supposed to send
+	Total int
+	// number of requests actually sent
+	Sent int
+	// number of requests not answered within -request_timeout
+	TimedOut int
+	Duration time.Duration
+	// every answered request, in the order the answers came in
+	Answers []Answer
+	// every request sent or that failed to send, in that order
+	Requests []Request
+}
+
+// an answered request of a test
+type Answer struct {
+	// when the schedule started its testFunc
+	Offset time.Duration
+	// the first request of a testFunc is measured from when the schedule wanted it sent,
+	// so a slow hss holding back the next requests shows up in the numbers
+	Latency time.Duration
+	Success bool
+	// address of the peer that answered
+	Peer string
+	// ULR, AIR...
+	Procedure string
+}
+
+// a request of a test and what came of it
+type Request struct {
+	SID  int
+	IMSI string
+	// address of the peer that answered or that the request timed out on,
+	// empty if it failed to send
+	Peer      string
+	Procedure string
+	// answered, timeout or send_error
+	Outcome    string
+	ResultCode string
+	// 0 unless answered, measured like Answer.Latency
+	Latency time.Duration
+}
+
+// latencies of every answered request
+func (result TestResult) Latencies() []time.Duration {
+	latencies := make([]time.Duration, len(result.Answers))
+	for i := 0; i < len(result.Answers); i++ {
+		latencies[i] = result.Answers[i].Latency
+	}
+	return latencies
+}
+
 // the main fun of this repo!
-// runs the given testFunc and returns success/failure count
+// runs the given testFunc at the times of a schedule and returns what came of it
 // purpose is to create any testFunc (load test, test multiple hss) and
 // use this method to run the test
-// return: success count, failure count, duration of test
+// return: success, failure, timeout counts, duration of test and every answer
 // parameters:
 // - testFunc: a function with parameters[]int of sids, imsi string,
 // 			   sent channel, sentErr channel
-// - imsis: string array of imsis to test
-// - numRequests: number of times we will call testFunc
+// - imsis: source of the imsi of each testFunc
+// - schedule: when to call testFunc, and how many times
 // - numRequestsPerTest: number of requests in each testFunc
 // - printReceived: print stats of each individual received answer
-func runTest(testFunc func([]int, *string, chan int, chan struct{}),
-	imsis []*string, numRequests int, numRequestsPerTest int,
-	printReceived bool) (int, int, time.Duration) {
+func runScheduledTest(testFunc func([]int, *string, chan int, chan int),
+	imsis IMSISource, schedule Schedule, numRequestsPerTest int,
+	printReceived bool) TestResult {
 	var startTime, endTime time.Time
 
-	successes := 0
-	failures := 0
+	result := TestResult{Total: schedule.Count * numRequestsPerTest}
 	sentCount := 0
 	recCount := 0
-	currIMSIIndex := 0
+	errCount := 0
 
-	sentIds := make([]int, numRequests*numRequestsPerTest)
+	sentIds := make([]int, result.Total)
 	// these maps would probably make more sense in a struct instead of 4 individual maps
 	// sid to time the request was sent
 	sentTimes := make(map[int]time.Time)
+	// sid to time the schedule wanted the request sent, first request of each testFunc only
+	intendedTimes := make(map[int]time.Time)
+	// sid to the offset of its testFunc in the schedule
+	sidOffsets := make(map[int]time.Duration)
 	// sid to time the request was received
 	receivedTimes := make(map[int]time.Duration)
 	// sid to imsi that was sent in request
 	sidToImsi := make(map[int]string)
 	// sid to remote address request was sent to/received from
 	sidToRemoteAddr := make(map[int]net.Addr)
+	// sids in the order they were sent or failed to send, and what came of them
+	var requestOrder []int
+	requests := make(map[int]*Request)
+	// lock held
+	request := func(sid int) *Request {
+		req, ok := requests[sid]
+		if !ok {
+			// an answer can come in before its sid is sent back
+			req = &Request{SID: sid, IMSI: sidToImsi[sid], Outcome: "timeout"}
+			requests[sid] = req
+			requestOrder = append(requestOrder, sid)
+		}
+		return req
+	}
 
 	sent := make(chan int)
-	sentErr := make(chan struct{})
+	sentErr := make(chan int)
+	// closed once every testFunc is started
+	dispatched := make(chan struct{})
+	// closed to stop starting testFuncs when the test is given up
+	stop := make(chan struct{})
+	defer close(stop)
+	// testFuncs still running
+	var running sync.WaitGroup
+	// requests time out on their own, see transactionTable
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	lastActivity := time.Now()
 
 	startTime = time.Now()
+	done := make(chan struct{})
+	resultsLock.Lock()
+	resultsDone = done
+	resultsLock.Unlock()
 
-	for i := 0; i < numRequests; i, currIMSIIndex = i+1, currIMSIIndex+1 {
-		// loops through imsi indices with numRequests
-		if currIMSIIndex == len(imsis) {
-			currIMSIIndex = 0
-		}
+	go func() {
+		defer close(dispatched)
+		next := schedule.Offsets()
+		for offset, ok := next(); ok; offset, ok = next() {
+			intended := startTime.Add(offset)
+			if wait := intended.Sub(time.Now()); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return
+				case <-shuttingDown:
+					return
+				}
+			}
+			if isShuttingDown() {
+				return
+			}
+			imsi := imsis.Next()
 
-		// assign random values to sids for each request for testFunc
-		randomVals := make([]int, numRequestsPerTest)
-		for j := 0; j < numRequestsPerTest; j++ {
-			randomVals[j] = int(rand.Uint32())
-			_, ok := sentTimes[randomVals[j]]
-			for ok {
-				randomVals[j] = int(rand.Uint32())
-				_, ok = sentTimes[randomVals[j]]
+			// assign sids for each request for testFunc, all in one session
+			randomVals := make([]int, numRequestsPerTest)
+			lock.Lock()
+			for j := 0; j < numRequestsPerTest; j++ {
+				randomVals[j] = nextSID()
+				sidToImsi[randomVals[j]] = *imsi
+				sidOffsets[randomVals[j]] = offset
 			}
-			sidToImsi[randomVals[j]] = *imsis[currIMSIIndex]
-		}
+			intendedTimes[randomVals[0]] = intended
+			lock.Unlock()
+			openSession(randomVals)
 
-		// start a goroutine for the testFunc
-		go testFunc(randomVals, imsis[currIMSIIndex], sent, sentErr)
-	}
+			// start a goroutine for the testFunc
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				testFunc(randomVals, imsi, sent, sentErr)
+			}()
+		}
+	}()
 
 Wait:
 	// wait for all of the requests to be sent and
 	// all of the requests to be answered
-	for recCount < numRequests*numRequestsPerTest {
+	for recCount < result.Total {
 		var r int
 		select {
 		case r = <-sent:
@@ -84,39 +248,132 @@ Wait:
 			sentTimes[r] = currTime
 			sentIds[sentCount] = r
 			sentCount++
+			request(r)
 			lock.Unlock()
+			lastActivity = currTime
 			// log.Printf("sent %d %v\n", sentCount, sentTimes[r])
 		case r := <-received:
 			currTime := time.Now()
 			lock.Lock()
+			if _, ok := sidToImsi[r.sid]; !ok {
+				// an answer to a request of an earlier test or of no test, it is not this one's
+				lock.Unlock()
+				continue
+			}
 			// record result
 			if r.result == 0 {
-				successes++
+				result.Successes++
 			} else {
-				failures++
+				result.Failures++
 			}
 			// record how long the request took to come back
-			receivedTimes[r.sid] = currTime.Sub(sentTimes[r.sid])
+			sentTime, ok := intendedTimes[r.sid]
+			if !ok {
+				sentTime = sentTimes[r.sid]
+			}
+			receivedTimes[r.sid] = currTime.Sub(sentTime)
+			peer := peerName(r.remoteAddr)
+			observeLatency(peer, r.procedure, receivedTimes[r.sid])
+			result.Answers = append(result.Answers,
+				Answer{sidOffsets[r.sid], receivedTimes[r.sid], r.result == 0, peer, r.procedure})
 			sidToRemoteAddr[r.sid] = r.remoteAddr
+			req := request(r.sid)
+			req.Peer, req.Procedure, req.Outcome, req.ResultCode, req.Latency =
+				peer, r.procedure, "answered", r.resultCode, receivedTimes[r.sid]
 			recCount++
 			lock.Unlock()
+			lastActivity = currTime
 			// log.Printf("received %d from %s\n", r.sid, r.remoteAddr)
-		case <-sentErr:
+		case r = <-sentErr:
+			// a failure, it is not going to be answered but the other requests carry on
+			lock.Lock()
+			request(r).Outcome = "send_error"
 			sentCount++
-			log.Printf("sending %d request failed", sentCount+1)
-			break Wait
-		// wait 20 seconds for responses to come back
-		case <-time.After(20 * time.Second):
+			errCount++
+			result.Failures++
+			recCount++
+			lock.Unlock()
+			lastActivity = time.Now()
+			log.Printf("sending request %d failed", sentCount)
+		case now := <-ticker.C:
+			lock.Lock()
+			for _, tx := range expireTransactions(now) {
+				// other tests' and re-attach requests time out here too
+				if _, ok := sentTimes[tx.SID]; ok {
+					timedOut(request(tx.SID), tx)
+					result.TimedOut++
+					recCount++
+					lastActivity = now
+				}
+			}
+			answered := recCount-errCount >= len(sentTimes)
+			lock.Unlock()
+			// on shutdown only the requests already sent are waited for
+			if answered && isShuttingDown() {
+				select {
+				case <-dispatched:
+					log.Printf("shutting down, stopped after %d requests", sentCount)
+					break Wait
+				default:
+				}
+			}
+			// wait 20 seconds for a testFunc that gave up to send its requests,
+			// a slow schedule may not send anything for a while
+			if now.Sub(lastActivity) < 20*time.Second {
+				continue
+			}
+			select {
+			case <-dispatched:
+			default:
+				continue
+			}
 			log.Printf("timed out waiting for ULR")
 			break Wait
 		}
 	}
 
 	endTime = time.Now()
+	// answers from here on are dropped, the handlers of late ones must not block
+	close(done)
+	result.Sent = sentCount
+	// let the testFuncs still running send, so they don't block forever
+	go func() {
+		finished := make(chan struct{})
+		go func() {
+			<-dispatched
+			running.Wait()
+			close(finished)
+		}()
+		for {
+			select {
+			case <-sent:
+			case <-sentErr:
+			case <-finished:
+				return
+			}
+		}
+	}()
+	// answers to requests the test gave up on are late ones
+	lock.Lock()
+	for _, tx := range abandonTransactions(sentTimes) {
+		timedOut(request(tx.SID), tx)
+		result.TimedOut++
+	}
+	for _, sid := range requestOrder {
+		result.Requests = append(result.Requests, *requests[sid])
+	}
+	sids := make([]int, 0, len(sidToImsi))
+	for sid := range sidToImsi {
+		sids = append(sids, sid)
+	}
+	closeSessions(sids)
+	lock.Unlock()
+	result.Duration = endTime.Sub(startTime)
 
 	// if we want to log all stats of each received answer
 	// log the sid, imsi, remote address, and duration of request
 	if printReceived {
+		lock.Lock()
 		for i := 0; i < len(sentIds); i++ {
 			dur, ok := receivedTimes[sentIds[i]]
 			if ok {
@@ -126,7 +383,13 @@ Wait:
 				log.Printf("failed to receive %d with sid %d\n", i+1, sentIds[i])
 			}
 		}
+		lock.Unlock()
 	}
 
-	return successes, failures, endTime.Sub(startTime)
+	return result
+}
+
+// fill in where a request that timed out went
+func timedOut(req *Request, tx *Transaction) {
+	req.Peer, req.Procedure = peerName(tx.conn.RemoteAddr()), tx.Procedure
 }
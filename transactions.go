@@ -0,0 +1,307 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/diam"
+	"github.com/fiorix/go-diameter/diam/avp"
+	"github.com/fiorix/go-diameter/diam/datatype"
+)
+
+// an outstanding request, answered by the answer with its End-to-End ID
+type Transaction struct {
+	SID       int
+	SessionID string
+	EndToEnd  uint32
+	Command   uint32
+	Procedure string
+	Deadline  time.Time
+	// where and what to retransmit
+	conn diam.Conn
+	msg  *diam.Message
+	// number of times it was retransmitted
+	retries int
+}
+
+// a transaction that is over, so a second answer to it can be told apart
+type finishedTransaction struct {
+	expired bool
+	at      time.Time
+	// whether it was retransmitted and what its first answer said, to tell how the hss
+	// answers the second copy
+	retransmitted bool
+	result        string
+}
+
+// where answers are matched with the requests they answer, so an hss that rewrites or
+// echoes a different Session-Id can't mix up results
+// answers to no outstanding request are counted as late (the request timed out),
+// duplicate (it was already answered) or unsolicited (it was never sent) and dropped
+type transactionTable struct {
+	lock sync.Mutex
+	// End-to-End ID to outstanding request
+	byEndToEnd map[uint32]*Transaction
+	// normalized Session-Id and command code to the last outstanding request, for answers
+	// with a wrong End-to-End ID
+	bySession map[sessionKey]*Transaction
+	// End-to-End IDs of answered and timed out requests, forgotten after a while
+	finished  map[uint32]finishedTransaction
+	lastPurge time.Time
+	// number of late, duplicate... answers since the last printAnswerAnomalies
+	anomalies map[string]int
+}
+
+type sessionKey struct {
+	sessionID string
+	command   uint32
+}
+
+var transactions = transactionTable{
+	byEndToEnd: make(map[uint32]*Transaction),
+	bySession:  make(map[sessionKey]*Transaction),
+	finished:   make(map[uint32]finishedTransaction),
+	anomalies:  make(map[string]int),
+}
+
+// register a request about to be sent to c for sid, it times out after -request_timeout
+func startTransaction(sid int, c diam.Conn, m *diam.Message, procedure string) {
+	tx := &Transaction{
+		SID:       sid,
+		SessionID: sessionIDOf(m),
+		EndToEnd:  m.Header.EndToEndID,
+		Command:   m.Header.CommandCode,
+		Procedure: procedure,
+		Deadline:  time.Now().Add(*requestTimeout),
+		conn:      c,
+		msg:       m,
+	}
+	t := &transactions
+	t.lock.Lock()
+	t.byEndToEnd[tx.EndToEnd] = tx
+	t.bySession[sessionKey{normalizeSessionID(tx.SessionID), tx.Command}] = tx
+	t.lock.Unlock()
+}
+
+// forget a request that could not be sent
+func abortTransaction(m *diam.Message) {
+	t := &transactions
+	t.lock.Lock()
+	tx, ok := t.byEndToEnd[m.Header.EndToEndID]
+	if ok {
+		t.remove(tx)
+	}
+	t.lock.Unlock()
+	if ok {
+		forgetRequest(tx.SID)
+	}
+}
+
+// drop what the handlers keep for the answer to the request of sid, which is not coming:
+// it timed out or could not be sent
+func forgetRequest(sid int) {
+	subscriberOf(sid)
+	forgetAIA(sid)
+	updateAttachment(sid, false, false)
+	isReattach(sid)
+}
+
+// register, send and count a request
+func sendRequest(c diam.Conn, m *diam.Message, sid int, procedure string) error {
+	c = reroute(c, m)
+	startTransaction(sid, c, m, procedure)
+	_, err := m.WriteTo(c)
+	countSent(c, procedure, err)
+	if err != nil {
+		abortTransaction(m)
+	}
+	return err
+}
+
+func sessionIDOf(m *diam.Message) string {
+	if a, err := m.FindAVP(avp.SessionID, 0); err == nil {
+		if v, ok := a.Data.(datatype.UTF8String); ok {
+			return string(v)
+		}
+	}
+	return ""
+}
+
+// the outstanding request an answer is for, by its End-to-End ID or failing that its Session-Id
+// return: the sid of the request, false if the answer is for no outstanding request and
+// has to be dropped
+func matchAnswer(m *diam.Message) (int, bool) {
+	sessionID := sessionIDOf(m)
+	t := &transactions
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tx, ok := t.byEndToEnd[m.Header.EndToEndID]
+	switch {
+	case ok && normalizeSessionID(tx.SessionID) != normalizeSessionID(sessionID):
+		// the End-to-End ID is what identifies the answer, the hss just got the Session-Id wrong
+		t.anomaly("session_id_mismatch", "answer %d has Session-Id %q, the request had %q",
+			m.Header.EndToEndID, sessionID, tx.SessionID)
+	case !ok:
+		if f, done := t.finished[m.Header.EndToEndID]; done {
+			if f.retransmitted && !f.expired {
+				// both copies of a retransmitted request were answered
+				if result := answerResult(m); result == f.result {
+					countRetransmission("duplicate_same_result")
+				} else {
+					log.Printf("answers %d of %s differ: %s then %s", m.Header.EndToEndID, sessionID, f.result, result)
+					countRetransmission("duplicate_different_result")
+				}
+				return 0, false
+			}
+			if f.expired {
+				t.anomaly("late", "answer %d of %s came after the request timed out", m.Header.EndToEndID, sessionID)
+			} else {
+				t.anomaly("duplicate", "answer %d of %s was already answered", m.Header.EndToEndID, sessionID)
+			}
+			return 0, false
+		}
+		tx, ok = t.bySession[sessionKey{normalizeSessionID(sessionID), m.Header.CommandCode}]
+		if !ok {
+			t.anomaly("unsolicited", "answer %d of %s matches no request", m.Header.EndToEndID, sessionID)
+			return 0, false
+		}
+		t.anomaly("end_to_end_id_mismatch", "answer of %s has End-to-End ID %d, the request had %d",
+			sessionID, m.Header.EndToEndID, tx.EndToEnd)
+	}
+	if tx.retries > 0 {
+		countRetransmission("answered_after_retransmission")
+	}
+	t.remove(tx)
+	t.finished[tx.EndToEnd] = finishedTransaction{false, time.Now(), tx.retries > 0, answerResult(m)}
+	return tx.SID, true
+}
+
+// time out every request past its deadline, or retransmit it if it has -request_retries left
+// return: the requests that timed out
+func expireTransactions(now time.Time) []*Transaction {
+	return transactions.expire(func(tx *Transaction) bool { return now.After(tx.Deadline) }, true)
+}
+
+// time out the outstanding requests of a test that gave up on them
+// return: the requests that timed out
+func abandonTransactions(sids map[int]time.Time) []*Transaction {
+	return transactions.expire(func(tx *Transaction) bool {
+		_, ok := sids[tx.SID]
+		return ok
+	}, false)
+}
+
+func (t *transactionTable) expire(expired func(*Transaction) bool, retransmit bool) []*Transaction {
+	t.lock.Lock()
+	now := time.Now()
+	var txs []*Transaction
+	var resend []retransmission
+	for _, tx := range t.byEndToEnd {
+		if !expired(tx) {
+			continue
+		}
+		if retransmit && tx.retries < *requestRetries {
+			tx.retries++
+			tx.Deadline = now.Add(*requestTimeout)
+			resend = append(resend, retransmission{tx.conn, tx.msg, tx.Procedure})
+			continue
+		}
+		t.remove(tx)
+		t.finished[tx.EndToEnd] = finishedTransaction{true, now, tx.retries > 0, ""}
+		txs = append(txs, tx)
+	}
+	// late and duplicate answers after this are taken for unsolicited ones
+	if now.Sub(t.lastPurge) > *requestTimeout {
+		for e2e, f := range t.finished {
+			if now.Sub(f.at) > 10**requestTimeout {
+				delete(t.finished, e2e)
+			}
+		}
+		t.lastPurge = now
+	}
+	t.lock.Unlock()
+
+	if len(txs) != 0 {
+		countTimeouts(len(txs))
+	}
+	for _, tx := range txs {
+		forgetRequest(tx.SID)
+	}
+	for _, r := range resend {
+		go r.send()
+	}
+	return txs
+}
+
+// number of requests still waiting for their answer
+func pendingTransactions() int {
+	t := &transactions
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.byEndToEnd)
+}
+
+// remember where a retransmitted request went and what was sent, its Session-Id changes
+// when it fails over to the mme of another host
+func (t *transactionTable) resent(m *diam.Message, c diam.Conn) {
+	t.lock.Lock()
+	if tx, ok := t.byEndToEnd[m.Header.EndToEndID]; ok {
+		tx.conn, tx.msg = c, m
+		if sessionID := sessionIDOf(m); sessionID != tx.SessionID {
+			t.remove(tx)
+			tx.SessionID = sessionID
+			t.byEndToEnd[tx.EndToEnd] = tx
+			t.bySession[sessionKey{normalizeSessionID(tx.SessionID), tx.Command}] = tx
+		}
+	}
+	t.lock.Unlock()
+}
+
+// the Result-Code or Experimental-Result-Code of an answer
+func answerResult(m *diam.Message) string {
+	_, resultCode, experimentalResultCode := answerCodes(m)
+	if resultCode == "" {
+		return experimentalResultCode
+	}
+	return resultCode
+}
+
+// lock held
+func (t *transactionTable) remove(tx *Transaction) {
+	delete(t.byEndToEnd, tx.EndToEnd)
+	key := sessionKey{normalizeSessionID(tx.SessionID), tx.Command}
+	if t.bySession[key] == tx {
+		delete(t.bySession, key)
+	}
+}
+
+// lock held
+func (t *transactionTable) anomaly(kind string, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	t.anomalies[kind]++
+	metrics.add("mock_mme_answer_anomalies_total", labels("kind", kind), 1)
+}
+
+// print the late, duplicate, unsolicited and mismatched answers since the last call,
+// nothing if there were none
+func printAnswerAnomalies() {
+	t := &transactions
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.anomalies) == 0 {
+		return
+	}
+	var kinds []string
+	for kind := range t.anomalies {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	log.Printf("   Answer Anomalies:\n")
+	for _, kind := range kinds {
+		log.Printf("      %s: %d\n", kind, t.anomalies[kind])
+	}
+	t.anomalies = make(map[string]int)
+}
@@ -10,13 +10,18 @@ type ReceivedResult struct {
 	sid        int
 	result     int
 	remoteAddr net.Addr
+	// request the answer is for, ULR, AIR...
+	procedure string
+	// Result-Code or Experimental-Result-Code of the answer
+	resultCode string
 }
 
 type EUtranVector struct {
-	RAND  datatype.OctetString `avp:"RAND"`
-	XRES  datatype.OctetString `avp:"XRES"`
-	AUTN  datatype.OctetString `avp:"AUTN"`
-	KASME datatype.OctetString `avp:"KASME"`
+	ItemNumber uint32               `avp:"Item-Number"`
+	RAND       datatype.OctetString `avp:"RAND"`
+	XRES       datatype.OctetString `avp:"XRES"`
+	AUTN       datatype.OctetString `avp:"AUTN"`
+	KASME      datatype.OctetString `avp:"KASME"`
 }
 
 type ExperimentalResult struct {
@@ -24,7 +29,7 @@ type ExperimentalResult struct {
 }
 
 type AuthenticationInfo struct {
-	EUtranVector EUtranVector `avp:"E-UTRAN-Vector"`
+	EUtranVectors []EUtranVector `avp:"E-UTRAN-Vector"`
 }
 
 type AIA struct {
@@ -34,7 +39,7 @@ type AIA struct {
 	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
 	AuthSessionState   datatype.UTF8String       `avp:"Auth-Session-State"`
 	ExperimentalResult ExperimentalResult        `avp:"Experimental-Result"`
-	AIs                []AuthenticationInfo      `avp:"Authentication-Info"`
+	AI                 AuthenticationInfo        `avp:"Authentication-Info"`
 }
 
 type AMBR struct {
@@ -53,28 +58,43 @@ type EPSSubscribedQoSProfile struct {
 	AllocationRetentionPriority AllocationRetentionPriority `avp:"Allocation-Retention-Priority"`
 }
 
+type MIPHomeAgentHost struct {
+	DestinationRealm datatype.DiameterIdentity `avp:"Destination-Realm"`
+	DestinationHost  datatype.DiameterIdentity `avp:"Destination-Host"`
+}
+
+type MIP6AgentInfo struct {
+	MIPHomeAgentAddresses []datatype.Address `avp:"MIP-Home-Agent-Address"`
+	MIPHomeAgentHost      *MIPHomeAgentHost  `avp:"MIP-Home-Agent-Host"`
+}
+
 type APNConfiguration struct {
-	ContextIdentifier       uint32                  `avp:"Context-Identifier"`
-	PDNType                 int32                   `avp:"PDN-Type"`
-	ServiceSelection        string                  `avp:"Service-Selection"`
-	EPSSubscribedQoSProfile EPSSubscribedQoSProfile `avp:"EPS-Subscribed-QoS-Profile"`
-	AMBR                    AMBR                    `avp:"AMBR"`
+	ContextIdentifier          uint32                  `avp:"Context-Identifier"`
+	ServedPartyIPAddresses     []datatype.Address      `avp:"Served-Party-IP-Address"`
+	PDNType                    int32                   `avp:"PDN-Type"`
+	ServiceSelection           string                  `avp:"Service-Selection"`
+	EPSSubscribedQoSProfile    EPSSubscribedQoSProfile `avp:"EPS-Subscribed-QoS-Profile"`
+	VPLMNDynamicAddressAllowed *int32                  `avp:"VPLMN-Dynamic-Address-Allowed"`
+	MIP6AgentInfo              *MIP6AgentInfo          `avp:"MIP6-Agent-Info"`
+	PDNGWAllocationType        *int32                  `avp:"PDN-GW-Allocation-Type"`
+	ChargingCharacteristics    *string                 `avp:"TGPP-Charging-Characteristics"`
+	AMBR                       AMBR                    `avp:"AMBR"`
 }
 
 type APNConfigurationProfile struct {
-	ContextIdentifier                     uint32           `avp:"Context-Identifier"`
-	AllAPNConfigurationsIncludedIndicator int32            `avp:"All-APN-Configurations-Included-Indicator"`
-	APNConfiguration                      APNConfiguration `avp:"APN-Configuration"`
+	ContextIdentifier                     uint32             `avp:"Context-Identifier"`
+	AllAPNConfigurationsIncludedIndicator int32              `avp:"All-APN-Configurations-Included-Indicator"`
+	APNConfigurations                     []APNConfiguration `avp:"APN-Configuration"`
 }
 
 type SubscriptionData struct {
 	MSISDN                        datatype.OctetString    `avp:"MSISDN"`
-	AccessRestrictionData         uint32                  `avp:"Access-Restriction-Data"`
-	SubscriberStatus              int32                   `avp:"Subscriber-Status"`
-	NetworkAccessMode             int32                   `avp:"Network-Access-Mode"`
-	AMBR                          AMBR                    `avp:"AMBR"`
+	AccessRestrictionData         *uint32                 `avp:"Access-Restriction-Data"`
+	SubscriberStatus              *int32                  `avp:"Subscriber-Status"`
+	NetworkAccessMode             *int32                  `avp:"Network-Access-Mode"`
+	AMBR                          *AMBR                   `avp:"AMBR"`
 	APNConfigurationProfile       APNConfigurationProfile `avp:"APN-Configuration-Profile"`
-	SubscribedPeriodicRauTauTimer uint32                  `avp:"Subscribed-Periodic-RAU-TAU-Timer"`
+	SubscribedPeriodicRauTauTimer *uint32                 `avp:"Subscribed-Periodic-RAU-TAU-Timer"`
 }
 
 type ULA struct {
@@ -87,3 +107,78 @@ type ULA struct {
 	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
 	ExperimentalResult ExperimentalResult        `avp:"Experimental-Result"`
 }
+
+type DPA struct {
+	ResultCode  uint32                    `avp:"Result-Code"`
+	OriginHost  datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm datatype.DiameterIdentity `avp:"Origin-Realm"`
+}
+
+type PUA struct {
+	SessionID          string                    `avp:"Session-Id"`
+	PUAFlags           uint32                    `avp:"PUA-Flags"`
+	AuthSessionState   int32                     `avp:"Auth-Session-State"`
+	ResultCode         uint32                    `avp:"Result-Code"`
+	OriginHost         datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
+	ExperimentalResult ExperimentalResult        `avp:"Experimental-Result"`
+}
+
+type CLR struct {
+	SessionID        string                    `avp:"Session-Id"`
+	AuthSessionState int32                     `avp:"Auth-Session-State"`
+	OriginHost       datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm      datatype.DiameterIdentity `avp:"Origin-Realm"`
+	DestinationHost  datatype.DiameterIdentity `avp:"Destination-Host"`
+	DestinationRealm datatype.DiameterIdentity `avp:"Destination-Realm"`
+	UserName         string                    `avp:"User-Name"`
+	CancellationType int32                     `avp:"Cancellation-Type"`
+	CLRFlags         uint32                    `avp:"CLR-Flags"`
+}
+
+type IDR struct {
+	SessionID        string                    `avp:"Session-Id"`
+	AuthSessionState int32                     `avp:"Auth-Session-State"`
+	OriginHost       datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm      datatype.DiameterIdentity `avp:"Origin-Realm"`
+	UserName         string                    `avp:"User-Name"`
+	SubscriptionData SubscriptionData          `avp:"Subscription-Data"`
+	IDRFlags         uint32                    `avp:"IDR-Flags"`
+}
+
+type DSR struct {
+	SessionID          string                    `avp:"Session-Id"`
+	AuthSessionState   int32                     `avp:"Auth-Session-State"`
+	OriginHost         datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
+	UserName           string                    `avp:"User-Name"`
+	DSRFlags           uint32                    `avp:"DSR-Flags"`
+	ContextIdentifiers []uint32                  `avp:"Context-Identifier"`
+}
+
+type NOA struct {
+	SessionID          string                    `avp:"Session-Id"`
+	AuthSessionState   int32                     `avp:"Auth-Session-State"`
+	ResultCode         uint32                    `avp:"Result-Code"`
+	OriginHost         datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
+	ExperimentalResult ExperimentalResult        `avp:"Experimental-Result"`
+}
+
+type RSR struct {
+	SessionID        string                    `avp:"Session-Id"`
+	AuthSessionState int32                     `avp:"Auth-Session-State"`
+	OriginHost       datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm      datatype.DiameterIdentity `avp:"Origin-Realm"`
+	UserIDs          []string                  `avp:"User-Id"`
+}
+
+type ECA struct {
+	SessionID          string                    `avp:"Session-Id"`
+	AuthSessionState   int32                     `avp:"Auth-Session-State"`
+	ResultCode         uint32                    `avp:"Result-Code"`
+	OriginHost         datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm        datatype.DiameterIdentity `avp:"Origin-Realm"`
+	ExperimentalResult ExperimentalResult        `avp:"Experimental-Result"`
+	EquipmentStatus    *int32                    `avp:"Equipment-Status"`
+}
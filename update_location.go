@@ -1,8 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"log"
-	"strconv"
+	"sync"
 
 	"github.com/fiorix/go-diameter/diam"
 	"github.com/fiorix/go-diameter/diam/avp"
@@ -14,12 +15,15 @@ import (
 
 // Create & send Update-Location Request
 // sent back the sid through the sent channel
-func sendULR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, sent chan int, sentErr chan struct{}) {
+func sendULR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, sent chan int, sentErr chan int) {
 	meta, ok := smpeer.FromContext(c.Context())
 	if !ok {
-		sentErr <- struct{}{}
+		sentErr <- randomVal
+		return
 	}
-	sid := "session;" + strconv.Itoa(randomVal)
+	trackAttachment(randomVal, *imsi, c, cfg)
+	trackSubscriber(randomVal, *imsi)
+	sid := sessionIDFor(randomVal, string(cfg.OriginHost))
 	m := diam.NewRequest(diam.UpdateLocation, diam.TGPP_S6A_APP_ID, dict.Default)
 	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sid))
 	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
@@ -32,9 +36,9 @@ func sendULR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, sent ch
 	m.NewAVP(avp.ULRFlags, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.Unsigned32(ULR_FLAGS))
 	m.NewAVP(avp.VisitedPLMNID, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.OctetString(*plmnID))
 	// log.Printf("\nSending ULR to %s\n%s\n", c.RemoteAddr(), m)
-	_, err := m.WriteTo(c)
+	err := sendRequest(c, m, randomVal, "ULR")
 	if err != nil {
-		sentErr <- struct{}{}
+		sentErr <- randomVal
 	} else {
 		sent <- randomVal
 	}
@@ -45,17 +49,31 @@ func sendULR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, sent ch
 func handleUpdateLocationAnswer(received chan ReceivedResult) diam.HandlerFunc {
 	return func(c diam.Conn, m *diam.Message) {
 		// log.Printf("Received Update-Location Answer from %s\n%s\n", c.RemoteAddr(), m)
+		countAnswer(c, m, "ULR")
+		sid, ok := matchAnswer(m)
+		if !ok {
+			return
+		}
+		// re-attaches are not part of any test, their results stay off received
+		reattach := isReattach(sid)
+		sub := subscriberOf(sid)
 		var ula ULA
 		err := m.Unmarshal(&ula)
 		if err != nil {
 			log.Printf("ULA Unmarshal failed: %s", err)
-			received <- ReceivedResult{0, -2, c.RemoteAddr()}
+			updateAttachment(sid, false, true)
+			if !reattach {
+				sendResult(received, ReceivedResult{sid, -2, c.RemoteAddr(), "ULR", answerResult(m)})
+			}
 		} else {
-			sid, _ := strconv.Atoi(ula.SessionID[8:])
-			if validateULAResponse(ula) == 1 {
-				received <- ReceivedResult{sid, 0, c.RemoteAddr()}
+			valid := validateULAResponse(ula, sub)
+			updateAttachment(sid, valid == 1, true)
+			if reattach {
+				log.Printf("re-attach of %s answered with %d", ula.SessionID, ula.ResultCode)
+			} else if valid == 1 {
+				sendResult(received, ReceivedResult{sid, 0, c.RemoteAddr(), "ULR", answerResult(m)})
 			} else {
-				received <- ReceivedResult{sid, -1, c.RemoteAddr()}
+				sendResult(received, ReceivedResult{sid, -1, c.RemoteAddr(), "ULR", answerResult(m)})
 			}
 			// log.Printf("Unmarshaled UL Answer:\n%#+v\n", ula)
 			// log.Printf("ULA result code: 0x%x\n", ula.ResultCode)
@@ -63,11 +81,217 @@ func handleUpdateLocationAnswer(received chan ReceivedResult) diam.HandlerFunc {
 	}
 }
 
-func validateULAResponse(ula ULA) int {
+// a ULA is valid if it succeeded with a consistent APN profile and, for imsis
+// of the subscriber file, returned what the file says (sub is nil otherwise)
+func validateULAResponse(ula ULA, sub *Subscriber) int {
+	valid := 1
+	if ula.ResultCode == 0x7d1 {
+		profile := ula.SubscriptionData.APNConfigurationProfile
+		recordAPNs(apnNames(profile))
+		for _, problem := range apnProfileProblems(profile) {
+			log.Printf("ULA %s: %s", ula.SessionID, problem)
+			valid = 0
+		}
+	}
+	if sub != nil {
+		for _, mismatch := range sub.ulaMismatches(ula) {
+			log.Printf("ULA %s for %s: %s", ula.SessionID, sub.IMSI, mismatch)
+			valid = 0
+		}
+	}
 	if ula.ResultCode != 0x7d1 {
 		return 0
 	}
+	return valid
+}
+
+// Create & send Authentication-Information Request
+// asks for *vectors E-UTRAN vectors, sent back the sid through the sent channel
+func sendAIR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, sent chan int, sentErr chan int) {
+	sendResyncAIR(c, cfg, imsi, randomVal, nil, sent, sentErr)
+}
+
+// same as sendAIR, but with RAND || AUTS in Re-Synchronization-Info if resyncInfo is not nil
+func sendResyncAIR(c diam.Conn, cfg *sm.Settings, imsi *string, randomVal int, resyncInfo []byte,
+	sent chan int, sentErr chan int) {
+	meta, ok := smpeer.FromContext(c.Context())
+	if !ok {
+		sentErr <- randomVal
+		return
+	}
+	trackSubscriber(randomVal, *imsi)
+	sid := sessionIDFor(randomVal, string(cfg.OriginHost))
+	m := diam.NewRequest(diam.AuthenticationInformation, diam.TGPP_S6A_APP_ID, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sid))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, cfg.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, cfg.OriginRealm)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, meta.OriginRealm)
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, meta.OriginHost)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(*imsi))
+	m.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(0))
+	eutranInfo := &diam.GroupedAVP{
+		AVP: []*diam.AVP{
+			diam.NewAVP(avp.NumberOfRequestedVectors, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.Unsigned32(*vectors)),
+			diam.NewAVP(avp.ImmediateResponsePreferred, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.Unsigned32(0)),
+		},
+	}
+	if resyncInfo != nil {
+		eutranInfo.AddAVP(diam.NewAVP(avp.ResynchronizationInfo, avp.Vbit|avp.Mbit, uint32(*vendorID),
+			datatype.OctetString(resyncInfo)))
+	}
+	m.NewAVP(avp.RequestedEUTRANAuthenticationInfo, avp.Vbit|avp.Mbit, uint32(*vendorID), eutranInfo)
+	m.NewAVP(avp.VisitedPLMNID, avp.Vbit|avp.Mbit, uint32(*vendorID), datatype.OctetString(*plmnID))
+	// log.Printf("\nSending AIR to %s\n%s\n", c.RemoteAddr(), m)
+	err := sendRequest(c, m, randomVal, "AIR")
+	if err != nil {
+		sentErr <- randomVal
+	} else {
+		sent <- randomVal
+	}
+}
+
+// Handle AIA
+// send back the result through the ReceivedResult channel
+func handleAuthenticationInformationAnswer(received chan ReceivedResult) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		// log.Printf("Received Authentication-Information Answer from %s\n%s\n", c.RemoteAddr(), m)
+		countAnswer(c, m, "AIR")
+		sid, ok := matchAnswer(m)
+		if !ok {
+			return
+		}
+		sub := subscriberOf(sid)
+		var aia AIA
+		err := m.Unmarshal(&aia)
+		if err != nil {
+			log.Printf("AIA Unmarshal failed: %s", err)
+			forgetAIA(sid)
+			sendResult(received, ReceivedResult{sid, -2, c.RemoteAddr(), "AIR", answerResult(m)})
+		} else {
+			if validateAIAResponse(aia, sub) == 1 && validateResyncResponse(sid, aia, sub) == 1 {
+				sendResult(received, ReceivedResult{sid, 0, c.RemoteAddr(), "AIR", answerResult(m)})
+			} else {
+				sendResult(received, ReceivedResult{sid, -1, c.RemoteAddr(), "AIR", answerResult(m)})
+			}
+			deliverAIA(sid, aia)
+			// log.Printf("Unmarshaled AI Answer:\n%#+v\n", aia)
+		}
+	}
+}
+
+// an AIA is only valid if it succeeded and carries between 1 and *vectors
+// well-formed E-UTRAN vectors (the HSS may return fewer than requested)
+// that match what the Ki/OPc of the subscriber file or -ki/-opc produce
+func validateAIAResponse(aia AIA, sub *Subscriber) int {
+	if aia.ResultCode != 0x7d1 {
+		return 0
+	}
+	if sub != nil && sub.Status == "unknown" {
+		log.Printf("AIA %s for %s: unknown subscriber got vectors", aia.SessionID, sub.IMSI)
+		return 0
+	}
+	vs := aia.AI.EUtranVectors
+	if len(vs) == 0 || len(vs) > int(*vectors) {
+		log.Printf("AIA %s returned %d vectors, requested %d", aia.SessionID, len(vs), *vectors)
+		return 0
+	}
+	for i := 0; i < len(vs); i++ {
+		if len(vs[i].RAND) != 16 || len(vs[i].AUTN) != 16 || len(vs[i].KASME) != 32 ||
+			len(vs[i].XRES) < 4 || len(vs[i].XRES) > 16 {
+			log.Printf("AIA %s vector %d is malformed", aia.SessionID, i+1)
+			return 0
+		}
+	}
+	valid := 1
+	if sub != nil && sub.AMF != nil {
+		for i := 0; i < len(vs); i++ {
+			if amf := []byte(vs[i].AUTN)[6:8]; !bytes.Equal(amf, sub.AMF) {
+				log.Printf("AIA %s vector %d: AMF expected %x got %x", aia.SessionID, i+1, sub.AMF, amf)
+				valid = 0
+			}
+		}
+	}
+	// recompute every vector if we know the subscriber's keys
+	if keys := sub.keys(); keys != nil {
+		for i := 0; i < len(vs); i++ {
+			mismatches := keys.validateEUtranVector(vs[i], []byte(*plmnID))
+			for _, mismatch := range mismatches {
+				log.Printf("AIA %s vector %d: %s", aia.SessionID, i+1, mismatch)
+				valid = 0
+			}
+		}
+	}
+	return valid
+}
+
+// after a resynchronisation the HSS must only hand out vectors with a SQN above
+// the SQN_MS we sent in the AUTS
+func validateResyncResponse(sid int, aia AIA, sub *Subscriber) int {
+	aiaLock.Lock()
+	sqnMS, ok := resyncSQNs[sid]
+	delete(resyncSQNs, sid)
+	aiaLock.Unlock()
+	if !ok || aia.ResultCode != 0x7d1 {
+		return 1
+	}
+	vs := aia.AI.EUtranVectors
+	for i := 0; i < len(vs); i++ {
+		sqn := sqnFromBytes(sub.keys().sqnFromVector(vs[i]))
+		if sqn <= sqnMS {
+			log.Printf("AIA %s vector %d: SQN %d not above resynchronised SQN %d",
+				aia.SessionID, i+1, sqn, sqnMS)
+			return 0
+		}
+	}
 	return 1
 }
 
+// register that the AIA of sid answers a resynchronisation to sqnMS
+func expectResync(sid int, sqnMS uint64) {
+	aiaLock.Lock()
+	resyncSQNs[sid] = sqnMS
+	aiaLock.Unlock()
+}
+
+// get a channel the AIA of sid will be delivered to, for multi step procedures
+// that need something out of the answer (e.g. the RAND for an AUTS)
+func awaitAIA(sid int) chan AIA {
+	answer := make(chan AIA, 1)
+	aiaLock.Lock()
+	aiaWaiters[sid] = answer
+	aiaLock.Unlock()
+	return answer
+}
+
+func deliverAIA(sid int, aia AIA) {
+	aiaLock.Lock()
+	answer, ok := aiaWaiters[sid]
+	delete(aiaWaiters, sid)
+	aiaLock.Unlock()
+	if ok {
+		answer <- aia
+	}
+}
+
+// forget the resync and waiter of the AIR of sid, which is not answered: the waiter's
+// channel is closed so it stops waiting
+func forgetAIA(sid int) {
+	aiaLock.Lock()
+	answer, ok := aiaWaiters[sid]
+	delete(aiaWaiters, sid)
+	delete(resyncSQNs, sid)
+	aiaLock.Unlock()
+	if ok {
+		close(answer)
+	}
+}
+
 const ULR_FLAGS = 1<<1 | 1<<5
+
+var (
+	aiaLock sync.Mutex
+	// sid to channel waiting for its AIA
+	aiaWaiters = make(map[int]chan AIA)
+	// sid to SQN_MS sent in its AUTS
+	resyncSQNs = make(map[int]uint64)
+)